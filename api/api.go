@@ -0,0 +1,28 @@
+// Package api holds the JSON types gridwatch serves, for Go programs that
+// consume its feeds.
+package api
+
+// SolarData is the live state of every site, as carried by /sse and /ws.
+type SolarData struct {
+	Time      int64      `json:"time"`
+	Total_kwh float32    `json:"total_kwh"`
+	Day_kwh   float32    `json:"day_kwh"`
+	Week_kwh  float32    `json:"week_kwh"`
+	Year_kwh  float32    `json:"year_kwh"`
+	Current_w float32    `json:"current_w"`
+	Sites     []SiteData `json:"sites"`
+
+	// Stale is set when this is the last good data, re-sent because fresh
+	// data couldn't be fetched. Age is then how old it is in milliseconds.
+	Stale bool  `json:"stale,omitempty"`
+	Age   int64 `json:"age,omitempty"`
+}
+
+type SiteData struct {
+	Name     string  `json:"name"`
+	Snapshot float64 `json:"snapshot"`
+	Today    float64 `json:"today"`
+	Week     float64 `json:"week"`
+	Last_365 float64 `json:"year"`
+	Max      float64 `json:"max"`
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of querying the data source while it
+// is known to be down.
+var ErrCircuitOpen = errors.New("upstream circuit open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// Breaker stops requests going to an upstream that keeps failing. After
+// cfg.Failures consecutive failures it opens and fails requests straight
+// away. Once the backoff has passed it lets a single probe through: success
+// closes it, failure opens it again for twice as long, up to
+// cfg.MaxBackoff.
+type Breaker struct {
+	cfg BreakerConfig
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	backoff   time.Duration
+	openUntil time.Time
+}
+
+func NewBreaker(cfg BreakerConfig) *Breaker {
+	return &Breaker{cfg: cfg}
+}
+
+// Allow returns ErrCircuitOpen if a request shouldn't be made now. Every
+// allowed request must be followed by Record.
+func (b *Breaker) Allow() error {
+	if b.cfg.Failures <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return ErrCircuitOpen
+		}
+		slog.Info("probing upstream", "backoff", b.backoff)
+		b.state = breakerHalfOpen
+		return nil
+	case breakerHalfOpen:
+		// the probe is still out
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// Record notes the outcome of an allowed request. Only failures of the
+// upstream itself count against it; a request the caller gave up on says
+// nothing either way.
+func (b *Breaker) Record(err error) {
+	if b.cfg.Failures <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		if b.state == breakerHalfOpen {
+			b.state = breakerOpen
+		}
+	case upstreamDown(err):
+		b.failures++
+		switch {
+		case b.state == breakerOpen:
+			// a request from before it opened
+			return
+		case b.state == breakerHalfOpen:
+			b.backoff = min(2*b.backoff, b.cfg.MaxBackoff)
+		case b.failures >= b.cfg.Failures:
+			b.backoff = b.cfg.Backoff
+		default:
+			return
+		}
+		b.state = breakerOpen
+		b.openUntil = time.Now().Add(b.backoff)
+		slog.Warn("upstream circuit open", "failures", b.failures, "backoff", b.backoff, "err", err)
+	default:
+		if b.state != breakerClosed {
+			slog.Info("upstream circuit closed")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		b.backoff = 0
+	}
+}
+
+// upstreamDown says whether err means the data source itself is failing, as
+// opposed to answering a query with an error.
+func upstreamDown(err error) bool {
+	var netErr net.Error
+	var queryErr *QueryError
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr):
+		return true
+	case errors.As(err, &queryErr):
+		return queryErr.StatusCode >= 500
+	}
+	return false
+}
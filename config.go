@@ -0,0 +1,315 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every runtime option. Each option can be set with a command
+// line flag or a GRIDWATCH_ environment variable, the flag taking priority.
+type Config struct {
+	Port string
+	Host string
+
+	Source        string
+	Username      string
+	Password      string
+	PrometheusURL string
+	Metrics       MetricsConfig
+	Influx        InfluxConfig
+	DataFile      string
+	Shelly        ShellyConfig
+	Inverters     InverterConfig
+	MQTT          MQTTConfig
+	Fixtures      string
+	Record        string
+	Replay        ReplayConfig
+	Breaker       BreakerConfig
+
+	EstimatedDNC int
+	MonitoredDNC int
+	SitesFile    string
+	Discovery    time.Duration
+	AdminToken   string
+
+	ShutdownGrace time.Duration
+
+	ServeUI bool
+	APIBase string
+
+	CORS     CORSConfig
+	Security SecurityConfig
+	TLS      TLSConfig
+
+	LogLevel  string
+	LogFormat string
+	Tracing   TracingConfig
+
+	TrustedProxies  []string
+	RateLimit       RateLimitConfig
+	MaxStreams      int
+	MaxStreamsPerIP int
+	ReplayBuffer    int
+	SSE             SSEConfig
+	Poll            PollConfig
+}
+
+type CORSConfig struct {
+	AllowOrigins []string
+	AllowMethods []string
+	MaxAge       int
+}
+
+type SecurityConfig struct {
+	Enabled    bool
+	CSP        string
+	HSTSMaxAge int
+}
+
+type TLSConfig struct {
+	CertFile       string
+	KeyFile        string
+	ReloadInterval time.Duration
+	RedirectAddr   string
+}
+
+type TracingConfig struct {
+	Exporter    string
+	Endpoint    string
+	SampleRatio float64
+}
+
+type MetricsConfig struct {
+	Energy    string
+	Power     string
+	SiteLabel string
+	Match     string
+}
+
+type InfluxConfig struct {
+	URL    string
+	Token  string
+	Org    string
+	Bucket string
+	Field  string
+}
+
+type ShellyConfig struct {
+	Devices  []string
+	Interval time.Duration
+	History  time.Duration
+}
+
+type InverterConfig struct {
+	Devices  []string
+	Interval time.Duration
+	History  time.Duration
+}
+
+type MQTTConfig struct {
+	Broker      string
+	Username    string
+	Password    string
+	ClientID    string
+	PowerTopic  string
+	PowerField  string
+	EnergyTopic string
+	EnergyField string
+	EnergyUnit  string
+	History     time.Duration
+	Publish     string
+	Discovery   string
+}
+
+type ReplayConfig struct {
+	Day   string
+	Speed float64
+}
+
+type BreakerConfig struct {
+	Failures   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+type SSEConfig struct {
+	Heartbeat    time.Duration
+	Retry        time.Duration
+	WriteTimeout time.Duration
+}
+
+type PollConfig struct {
+	Day          time.Duration
+	Night        time.Duration
+	Scrape       time.Duration
+	ScrapeOffset time.Duration
+	Threshold    float64
+	MaxSilence   time.Duration
+}
+
+type RateLimitConfig struct {
+	Rate  float64
+	Burst int
+}
+
+func LoadConfig() Config {
+	var cfg Config
+
+	flag.StringVar(&cfg.Port, "port", envString("GRIDWATCH_PORT", "1323"), "Port to run on")
+	flag.StringVar(&cfg.Host, "host", envString("GRIDWATCH_HOST", "localhost"), "Host to listen on")
+
+	flag.StringVar(&cfg.Source, "source", envString("GRIDWATCH_SOURCE", "prometheus"), "Where readings come from: prometheus, victoriametrics, thanos, influxdb, file, shelly, mqtt or demo for made-up readings")
+	flag.StringVar(&cfg.Username, "username", envString("GRIDWATCH_USERNAME", "admin"), "Username for Prometheus Server")
+	flag.StringVar(&cfg.Password, "password", envString("GRIDWATCH_PASSWORD", "password"), "Password for Prometheus Server")
+	flag.StringVar(&cfg.PrometheusURL, "prometheus", envString("GRIDWATCH_PROM_URL", "http://localhost:9090"), "URL for Prometheus Server")
+	flag.StringVar(&cfg.Metrics.Energy, "metric-energy", envString("GRIDWATCH_METRIC_ENERGY", "total_import"), "Metric holding each site's energy meter reading in kWh")
+	flag.StringVar(&cfg.Metrics.Power, "metric-power", envString("GRIDWATCH_METRIC_POWER", "total_act_power"), "Metric holding each site's power in watts")
+	flag.StringVar(&cfg.Metrics.SiteLabel, "site-label", envString("GRIDWATCH_SITE_LABEL", "site"), "Label naming the site of each series")
+	flag.StringVar(&cfg.Metrics.Match, "match", envString("GRIDWATCH_MATCH", "purpose=solar"), "Comma separated label matchers every series must match, e.g. purpose=solar,job=~\"shelly.*\"")
+	flag.StringVar(&cfg.Influx.URL, "influx-url", envString("GRIDWATCH_INFLUX_URL", "http://localhost:8086"), "URL for InfluxDB Server")
+	flag.StringVar(&cfg.Influx.Token, "influx-token", envString("GRIDWATCH_INFLUX_TOKEN", ""), "API token for InfluxDB Server")
+	flag.StringVar(&cfg.Influx.Org, "influx-org", envString("GRIDWATCH_INFLUX_ORG", ""), "InfluxDB organization")
+	flag.StringVar(&cfg.Influx.Bucket, "influx-bucket", envString("GRIDWATCH_INFLUX_BUCKET", ""), "InfluxDB bucket holding the readings")
+	flag.StringVar(&cfg.Influx.Field, "influx-field", envString("GRIDWATCH_INFLUX_FIELD", "value"), "Field holding each reading in InfluxDB and data files, empty for any field")
+	flag.StringVar(&cfg.DataFile, "data-file", envString("GRIDWATCH_DATA_FILE", ""), "Line protocol file of readings for the file source")
+	shellyDevices := flag.String("shelly", envString("GRIDWATCH_SHELLY", ""), "Comma separated Shelly Pro 3EM meters for the shelly source, each site=address")
+	flag.DurationVar(&cfg.Shelly.Interval, "shelly-interval", envDuration("GRIDWATCH_SHELLY_INTERVAL", 10*time.Second), "How often to read the Shelly meters")
+	flag.DurationVar(&cfg.Shelly.History, "shelly-history", envDuration("GRIDWATCH_SHELLY_HISTORY", 48*time.Hour), "How long to keep Shelly readings, 0 to keep them all")
+	inverters := flag.String("inverters", envString("GRIDWATCH_INVERTERS", ""), "Comma separated SunSpec inverters to read over Modbus TCP alongside the data source, each site=host[:port][/unit], or site=simulator")
+	flag.DurationVar(&cfg.Inverters.Interval, "inverter-interval", envDuration("GRIDWATCH_INVERTER_INTERVAL", 10*time.Second), "How often to read the inverters")
+	flag.DurationVar(&cfg.Inverters.History, "inverter-history", envDuration("GRIDWATCH_INVERTER_HISTORY", 48*time.Hour), "How long to keep inverter readings, 0 to keep them all")
+	flag.StringVar(&cfg.MQTT.Broker, "mqtt-broker", envString("GRIDWATCH_MQTT_BROKER", ""), "MQTT broker to read readings from and publish to, e.g. tcp://localhost:1883")
+	flag.StringVar(&cfg.MQTT.Username, "mqtt-username", envString("GRIDWATCH_MQTT_USERNAME", ""), "Username for the MQTT broker")
+	flag.StringVar(&cfg.MQTT.Password, "mqtt-password", envString("GRIDWATCH_MQTT_PASSWORD", ""), "Password for the MQTT broker")
+	flag.StringVar(&cfg.MQTT.ClientID, "mqtt-client-id", envString("GRIDWATCH_MQTT_CLIENT_ID", "gridwatch"), "MQTT client ID prefix, also identifying gridwatch to Home Assistant")
+	flag.StringVar(&cfg.MQTT.PowerTopic, "mqtt-power-topic", envString("GRIDWATCH_MQTT_POWER_TOPIC", ""), "MQTT topic filter for power readings in watts, its first + level naming the site, e.g. meters/+/power")
+	flag.StringVar(&cfg.MQTT.PowerField, "mqtt-power-field", envString("GRIDWATCH_MQTT_POWER_FIELD", "value"), "Field of JSON power payloads holding the reading, dotted for nested objects")
+	flag.StringVar(&cfg.MQTT.EnergyTopic, "mqtt-energy-topic", envString("GRIDWATCH_MQTT_ENERGY_TOPIC", ""), "MQTT topic filter for energy meter readings, its first + level naming the site")
+	flag.StringVar(&cfg.MQTT.EnergyField, "mqtt-energy-field", envString("GRIDWATCH_MQTT_ENERGY_FIELD", "value"), "Field of JSON energy payloads holding the reading, dotted for nested objects")
+	flag.StringVar(&cfg.MQTT.EnergyUnit, "mqtt-energy-unit", envString("GRIDWATCH_MQTT_ENERGY_UNIT", "kWh"), "Unit of MQTT energy readings, kWh or Wh")
+	flag.DurationVar(&cfg.MQTT.History, "mqtt-history", envDuration("GRIDWATCH_MQTT_HISTORY", 48*time.Hour), "How long to keep MQTT readings, 0 to keep them all")
+	flag.StringVar(&cfg.MQTT.Publish, "mqtt-publish", envString("GRIDWATCH_MQTT_PUBLISH", ""), "Topic prefix to publish the live totals and sites under, empty to not publish")
+	flag.StringVar(&cfg.MQTT.Discovery, "mqtt-discovery", envString("GRIDWATCH_MQTT_DISCOVERY", "homeassistant"), "Home Assistant MQTT discovery prefix to announce the published sensors under, empty to not announce them")
+	flag.StringVar(&cfg.Fixtures, "fixtures", envString("GRIDWATCH_FIXTURES", ""), "Directory of recorded answers to serve instead of querying the data source")
+	flag.StringVar(&cfg.Record, "record", envString("GRIDWATCH_RECORD", ""), "Directory to record the answers served into, for -fixtures")
+	flag.StringVar(&cfg.Replay.Day, "replay-day", envString("GRIDWATCH_REPLAY_DAY", ""), "Past day to replay on the live feed instead of live data, e.g. 2024-06-21")
+	flag.Float64Var(&cfg.Replay.Speed, "replay-speed", envFloat("GRIDWATCH_REPLAY_SPEED", 60), "How many times faster than real time the day is replayed")
+	flag.IntVar(&cfg.Breaker.Failures, "breaker-failures", envInt("GRIDWATCH_BREAKER_FAILURES", 3), "Consecutive data source failures before queries stop being sent, 0 to never stop")
+	flag.DurationVar(&cfg.Breaker.Backoff, "breaker-backoff", envDuration("GRIDWATCH_BREAKER_BACKOFF", 5*time.Second), "How long to wait before probing the data source again once it is down")
+	flag.DurationVar(&cfg.Breaker.MaxBackoff, "breaker-max-backoff", envDuration("GRIDWATCH_BREAKER_MAX_BACKOFF", 2*time.Minute), "Longest wait between probes, the backoff doubling after each failed probe")
+
+	flag.IntVar(&cfg.EstimatedDNC, "estimate", envInt("GRIDWATCH_ESTIMATED_DNC", 500), "Estimated unmonitored solar capacity in kilowatts")
+	flag.IntVar(&cfg.MonitoredDNC, "dnc", envInt("GRIDWATCH_DNC", 20), "Monitored solar capacity in kilowatts")
+
+	flag.StringVar(&cfg.SitesFile, "sites-file", envString("GRIDWATCH_SITES_FILE", ""), "JSON file listing the sites and the groups they belong to")
+	flag.DurationVar(&cfg.Discovery, "discovery-interval", envDuration("GRIDWATCH_DISCOVERY_INTERVAL", 10*time.Minute), "How often to ask the data source which sites it has, 0 to not ask")
+	flag.StringVar(&cfg.AdminToken, "admin-token", envString("GRIDWATCH_ADMIN_TOKEN", ""), "Bearer token for the /admin endpoints, empty to not serve them")
+
+	flag.DurationVar(&cfg.ShutdownGrace, "grace", envDuration("GRIDWATCH_SHUTDOWN_GRACE", 30*time.Second), "Time allowed for in-flight requests to finish on shutdown")
+
+	flag.BoolVar(&cfg.ServeUI, "ui", envBool("GRIDWATCH_UI", true), "Serve the embedded dashboard")
+	flag.StringVar(&cfg.APIBase, "api-base", envString("GRIDWATCH_API_BASE", ""), "Base URL the dashboard uses for API calls (default same origin)")
+
+	corsOrigins := flag.String("cors-origins", envString("GRIDWATCH_CORS_ORIGINS", "*"), "Comma separated origins allowed to call the API")
+	corsMethods := flag.String("cors-methods", envString("GRIDWATCH_CORS_METHODS", "GET,HEAD"), "Comma separated methods allowed for cross-origin requests")
+	flag.IntVar(&cfg.CORS.MaxAge, "cors-max-age", envInt("GRIDWATCH_CORS_MAX_AGE", 3600), "Seconds browsers may cache a preflight response")
+
+	flag.BoolVar(&cfg.Security.Enabled, "security-headers", envBool("GRIDWATCH_SECURITY_HEADERS", false), "Send CSP, HSTS and X-Content-Type-Options headers")
+	flag.StringVar(&cfg.Security.CSP, "csp", envString("GRIDWATCH_CSP", defaultCSP), "Content-Security-Policy sent with security headers")
+	flag.IntVar(&cfg.Security.HSTSMaxAge, "hsts-max-age", envInt("GRIDWATCH_HSTS_MAX_AGE", 0), "Strict-Transport-Security max-age in seconds, 0 to disable")
+
+	flag.StringVar(&cfg.TLS.CertFile, "tls-cert", envString("GRIDWATCH_TLS_CERT", ""), "Certificate file to serve HTTPS with")
+	flag.StringVar(&cfg.TLS.KeyFile, "tls-key", envString("GRIDWATCH_TLS_KEY", ""), "Private key file for the TLS certificate")
+	flag.DurationVar(&cfg.TLS.ReloadInterval, "tls-reload", envDuration("GRIDWATCH_TLS_RELOAD", 30*time.Second), "How often to check the certificate files for changes, 0 to not reload them")
+	flag.StringVar(&cfg.TLS.RedirectAddr, "tls-redirect", envString("GRIDWATCH_TLS_REDIRECT", ""), "Address for a plain HTTP listener that redirects to HTTPS, e.g. :80")
+
+	flag.StringVar(&cfg.LogLevel, "log-level", envString("GRIDWATCH_LOG_LEVEL", "info"), "Log level: debug, info, warn or error")
+	flag.StringVar(&cfg.LogFormat, "log-format", envString("GRIDWATCH_LOG_FORMAT", "text"), "Log format: text or json")
+	flag.StringVar(&cfg.Tracing.Exporter, "trace-exporter", envString("GRIDWATCH_TRACE_EXPORTER", "none"), "Where to send traces: none, stdout or otlp")
+	flag.StringVar(&cfg.Tracing.Endpoint, "trace-endpoint", envString("GRIDWATCH_TRACE_ENDPOINT", ""), "OTLP/HTTP endpoint URL, defaults to the OTEL_EXPORTER_OTLP_* variables")
+	flag.Float64Var(&cfg.Tracing.SampleRatio, "trace-sample", envFloat("GRIDWATCH_TRACE_SAMPLE", 1), "Fraction of new traces to record")
+
+	trustedProxies := flag.String("trusted-proxies", envString("GRIDWATCH_TRUSTED_PROXIES", "127.0.0.1,::1"), "Comma separated proxy IPs or CIDRs whose X-Forwarded-For is believed, or none")
+	flag.Float64Var(&cfg.RateLimit.Rate, "rate-limit", envFloat("GRIDWATCH_RATE_LIMIT", 1), "Requests per second allowed to the JSON routes from each client, 0 to disable")
+	flag.IntVar(&cfg.RateLimit.Burst, "rate-burst", envInt("GRIDWATCH_RATE_BURST", 10), "Requests a client may make in a burst above the rate limit")
+	flag.IntVar(&cfg.MaxStreams, "sse-max", envInt("GRIDWATCH_SSE_MAX", 500), "Maximum concurrent live streams, 0 for no limit")
+	flag.IntVar(&cfg.MaxStreamsPerIP, "sse-max-per-ip", envInt("GRIDWATCH_SSE_MAX_PER_IP", 20), "Maximum concurrent live streams from one client, 0 for no limit")
+	flag.IntVar(&cfg.ReplayBuffer, "sse-replay", envInt("GRIDWATCH_SSE_REPLAY", 120), "Number of recent live updates kept to replay to reconnecting clients")
+	flag.DurationVar(&cfg.SSE.Heartbeat, "sse-heartbeat", envDuration("GRIDWATCH_SSE_HEARTBEAT", 15*time.Second), "Interval between keep-alive comments on idle live streams and WebSocket pings, 0 for none")
+	flag.DurationVar(&cfg.SSE.Retry, "sse-retry", envDuration("GRIDWATCH_SSE_RETRY", 10*time.Second), "Reconnection delay advertised to live stream clients, 0 to leave it to the browser")
+	flag.DurationVar(&cfg.SSE.WriteTimeout, "sse-write-timeout", envDuration("GRIDWATCH_SSE_WRITE_TIMEOUT", 10*time.Second), "Time allowed for a write to a live stream before the client is dropped")
+	flag.DurationVar(&cfg.Poll.Day, "poll-day", envDuration("GRIDWATCH_POLL_DAY", 15*time.Second), "Live data poll interval while the sun is up at any site")
+	flag.DurationVar(&cfg.Poll.Night, "poll-night", envDuration("GRIDWATCH_POLL_NIGHT", 5*time.Minute), "Live data poll interval overnight")
+	flag.DurationVar(&cfg.Poll.Scrape, "scrape-interval", envDuration("GRIDWATCH_SCRAPE_INTERVAL", 15*time.Second), "Prometheus scrape interval that polls are aligned to, 0 to not align")
+	flag.DurationVar(&cfg.Poll.ScrapeOffset, "scrape-offset", envDuration("GRIDWATCH_SCRAPE_OFFSET", 2*time.Second), "How long after each scrape interval boundary to poll")
+	flag.Float64Var(&cfg.Poll.Threshold, "push-threshold", envFloat("GRIDWATCH_PUSH_THRESHOLD", 10), "Watts a power value must move by before an update is pushed")
+	flag.DurationVar(&cfg.Poll.MaxSilence, "max-silence", envDuration("GRIDWATCH_MAX_SILENCE", 5*time.Minute), "Longest time without pushing an update, even if nothing changed")
+
+	flag.Parse()
+
+	cfg.APIBase = strings.TrimSuffix(cfg.APIBase, "/")
+	cfg.Shelly.Devices = splitList(*shellyDevices)
+	cfg.Inverters.Devices = splitList(*inverters)
+	cfg.CORS.AllowOrigins = splitList(*corsOrigins)
+	cfg.CORS.AllowMethods = splitList(*corsMethods)
+	if *trustedProxies != "none" {
+		cfg.TrustedProxies = splitList(*trustedProxies)
+	}
+
+	return cfg
+}
+
+// defaultCSP allows the dashboard's own assets plus the chartist stylesheet
+// it loads from jsdelivr.
+const defaultCSP = "default-src 'self'; style-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net; img-src 'self' data:; connect-src 'self'"
+
+func envString(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envFloat(name string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envBool(name string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
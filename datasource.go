@@ -0,0 +1,263 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DataSource answers questions about the sites' meters in solar terms,
+// leaving the query language to each backend. A site of "" asks about
+// every site, and results are keyed by site name. Ranges run from just
+// after start up to and including end.
+type DataSource interface {
+	// MeterReadings is the latest energy meter reading in kWh.
+	MeterReadings(ctx context.Context, site string, start, end time.Time) (Readings, error)
+	// CurrentPower is the latest power reading in watts.
+	CurrentPower(ctx context.Context, site string, start, end time.Time) (Readings, error)
+	// Energy is the kWh generated, the change in meter reading.
+	Energy(ctx context.Context, site string, start, end time.Time) (Readings, error)
+	// PowerSeries is the average power in watts over each step up to each
+	// point from start to end.
+	PowerSeries(ctx context.Context, site string, start, end time.Time, step time.Duration) (Series, error)
+	// PeakPower is the highest power reading in watts.
+	PeakPower(ctx context.Context, site string, start, end time.Time) (Readings, error)
+}
+
+// Collector is a DataSource that gathers its readings itself, for as long
+// as Run runs.
+type Collector interface {
+	Run(ctx context.Context)
+}
+
+// MergeSources answers from every one of sources at once, as if their
+// sites were all in one. Each site should come from only one source. A
+// source that fails is left out of the answer, and logged, so that one
+// backend being down doesn't blank the sites of the others; only when
+// every source fails does the query fail.
+//
+// The merged source can discover its sites only if every one of sources
+// can, since otherwise the sites of those that can't would all be taken
+// for missing.
+func MergeSources(sources ...DataSource) DataSource {
+	m := &mergedSource{}
+	for _, source := range sources {
+		switch merged := source.(type) {
+		case *mergedSource:
+			m.members = append(m.members, merged.members...)
+		case discoveringMergedSource:
+			m.members = append(m.members, merged.members...)
+		default:
+			m.members = append(m.members, &mergedMember{DataSource: source, name: strings.TrimPrefix(fmt.Sprintf("%T", source), "*main.")})
+		}
+	}
+	for _, member := range m.members {
+		if _, ok := member.DataSource.(SiteDiscoverer); !ok {
+			return m
+		}
+	}
+	return discoveringMergedSource{m}
+}
+
+type mergedSource struct {
+	members []*mergedMember
+}
+
+type mergedMember struct {
+	DataSource
+	name    string
+	failing atomic.Bool // so that only changes are logged
+
+	// the sites it last discovered, to stand in while discovery fails
+	mu      sync.Mutex
+	sites   []string
+	unknown []map[string]string
+}
+
+func (m *mergedSource) MeterReadings(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return mergeAnswers(ctx, m, func(s DataSource) (Readings, error) { return s.MeterReadings(ctx, site, start, end) })
+}
+
+func (m *mergedSource) CurrentPower(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return mergeAnswers(ctx, m, func(s DataSource) (Readings, error) { return s.CurrentPower(ctx, site, start, end) })
+}
+
+func (m *mergedSource) Energy(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return mergeAnswers(ctx, m, func(s DataSource) (Readings, error) { return s.Energy(ctx, site, start, end) })
+}
+
+func (m *mergedSource) PeakPower(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return mergeAnswers(ctx, m, func(s DataSource) (Readings, error) { return s.PeakPower(ctx, site, start, end) })
+}
+
+func (m *mergedSource) PowerSeries(ctx context.Context, site string, start, end time.Time, step time.Duration) (Series, error) {
+	return mergeAnswers(ctx, m, func(s DataSource) (Series, error) { return s.PowerSeries(ctx, site, start, end, step) })
+}
+
+// mergeAnswers puts together the answers of the sources that give one,
+// failing only if none does.
+func mergeAnswers[M ~map[string]V, V any](ctx context.Context, m *mergedSource, query func(DataSource) (M, error)) (M, error) {
+	merged := M{}
+	var firstErr error
+	answered := false
+	for _, member := range m.members {
+		answer, err := query(member.DataSource)
+		member.report(ctx, err)
+		if err != nil {
+			firstErr = cmp.Or(firstErr, err)
+			continue
+		}
+		answered = true
+		maps.Copy(merged, answer)
+	}
+	if !answered && firstErr != nil {
+		return nil, firstErr
+	}
+	return merged, nil
+}
+
+// report logs the source failing or answering again.
+func (member *mergedMember) report(ctx context.Context, err error) {
+	if err != nil {
+		trace.SpanFromContext(ctx).RecordError(fmt.Errorf("%s: %w", member.name, err))
+	}
+	switch {
+	case err != nil && !member.failing.Swap(true):
+		LoggerFrom(ctx).Warn("data source failed, answering without its sites", "source", member.name, "err", err)
+	case err == nil && member.failing.Swap(false):
+		LoggerFrom(ctx).Info("data source answering again", "source", member.name)
+	}
+}
+
+// discoveringMergedSource is a merged source all of whose sources can
+// discover their sites.
+type discoveringMergedSource struct {
+	*mergedSource
+}
+
+// DiscoverSites lists the sites of every source. A source whose discovery
+// fails is taken to still have the sites it had.
+func (m discoveringMergedSource) DiscoverSites(ctx context.Context) (sites []string, unknown []map[string]string, err error) {
+	var firstErr error
+	answered := false
+	for _, member := range m.members {
+		s, u, err := member.DataSource.(SiteDiscoverer).DiscoverSites(ctx)
+		member.report(ctx, err)
+		member.mu.Lock()
+		if err != nil {
+			firstErr = cmp.Or(firstErr, err)
+			s, u = member.sites, member.unknown
+		} else {
+			answered = true
+			member.sites, member.unknown = s, u
+		}
+		member.mu.Unlock()
+		sites, unknown = append(sites, s...), append(unknown, u...)
+	}
+	if !answered && firstErr != nil {
+		return nil, nil, firstErr
+	}
+	return sites, unknown, nil
+}
+
+// Run runs every source that collects its own readings.
+func (m *mergedSource) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, member := range m.members {
+		if collector, ok := member.DataSource.(Collector); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				collector.Run(ctx)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// Readings holds one value for each site.
+type Readings map[string]float64
+
+// Sites lists the sites with a reading, sorted.
+func (r Readings) Sites() []string {
+	return slices.Sorted(maps.Keys(r))
+}
+
+// Total adds up every site's reading.
+func (r Readings) Total() (total float64) {
+	for _, value := range r {
+		total += value
+	}
+	return total
+}
+
+// Point is one value of a time series.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Series holds a time series for each site.
+type Series map[string][]Point
+
+// Sum adds the sites' series together point by point.
+func (s Series) Sum() (sum []Point) {
+	totals := map[int64]float64{}
+	for _, points := range s {
+		for _, p := range points {
+			totals[p.Time.UnixMilli()] += p.Value
+		}
+	}
+	for ms, value := range totals {
+		sum = append(sum, Point{Time: time.UnixMilli(ms), Value: value})
+	}
+	slices.SortFunc(sum, func(a, b Point) int { return a.Time.Compare(b.Time) })
+	return sum
+}
+
+// seriesValues writes points the way Prometheus does, as
+// [unix seconds, "value"] pairs, which is what the dashboard reads.
+func seriesValues(points []Point) (values [][]interface{}) {
+	for _, p := range points {
+		values = append(values, []interface{}{float64(p.Time.UnixMilli()) / 1000, strconv.FormatFloat(p.Value, 'f', -1, 64)})
+	}
+	return values
+}
+
+// NewDataSource builds the backend cfg.Source names.
+func NewDataSource(cfg Config, registry *SiteRegistry) (DataSource, error) {
+	schema, err := NewMetricSchema(cfg.Metrics)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Source {
+	case "prometheus", "victoriametrics", "thanos":
+		return NewPrometheusSource(cfg.Source, cfg.PrometheusURL, cfg.Username, cfg.Password, schema), nil
+	case "influxdb":
+		if cfg.Influx.Bucket == "" {
+			return nil, fmt.Errorf("the influxdb source needs a bucket")
+		}
+		return NewInfluxSource(cfg.Influx, schema), nil
+	case "file":
+		if cfg.DataFile == "" {
+			return nil, fmt.Errorf("the file source needs a data file")
+		}
+		return NewFileSource(cfg.DataFile, cfg.Influx.Field, schema)
+	case "shelly":
+		return NewShellySource(cfg.Shelly)
+	case "mqtt":
+		return NewMQTTSource(cfg.MQTT)
+	case "demo":
+		return NewDemoSource(registry), nil
+	}
+	return nil, fmt.Errorf("unknown data source %q", cfg.Source)
+}
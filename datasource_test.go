@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// brokenSource fails every query while down, and otherwise answers from
+// its MemorySource.
+type brokenSource struct {
+	*MemorySource
+	down bool
+}
+
+var errDown = errors.New("upstream down")
+
+func (s *brokenSource) CurrentPower(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	if s.down {
+		return nil, errDown
+	}
+	return s.MemorySource.CurrentPower(ctx, site, start, end)
+}
+
+func (s *brokenSource) PowerSeries(ctx context.Context, site string, start, end time.Time, step time.Duration) (Series, error) {
+	if s.down {
+		return nil, errDown
+	}
+	return s.MemorySource.PowerSeries(ctx, site, start, end, step)
+}
+
+func (s *brokenSource) DiscoverSites(ctx context.Context) ([]string, []map[string]string, error) {
+	if s.down {
+		return nil, nil, errDown
+	}
+	return s.MemorySource.DiscoverSites(ctx)
+}
+
+func TestMergeSourcesPartial(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	prometheus := &brokenSource{MemorySource: NewMemorySource()}
+	prometheus.Add("Airport", MeasurePower, Point{Time: now, Value: 1000})
+	inverters := NewMemorySource()
+	inverters.Add("Big Array", MeasurePower, Point{Time: now, Value: 2000})
+	mqtt := NewMemorySource()
+	mqtt.Add("Harbour", MeasurePower, Point{Time: now, Value: 3000})
+	source := MergeSources(MergeSources(prometheus, inverters), mqtt)
+
+	power, err := source.CurrentPower(ctx, "", now.Add(-time.Minute), now)
+	if err != nil || len(power) != 3 {
+		t.Fatalf("CurrentPower = %v, %v, want all three sites", power, err)
+	}
+	sites, _, err := source.(SiteDiscoverer).DiscoverSites(ctx)
+	if err != nil || len(sites) != 3 {
+		t.Fatalf("DiscoverSites = %v, %v, want all three sites", sites, err)
+	}
+
+	prometheus.down = true
+	power, err = source.CurrentPower(ctx, "", now.Add(-time.Minute), now)
+	if err != nil || len(power) != 2 || power["Big Array"] != 2000 || power["Harbour"] != 3000 {
+		t.Errorf("CurrentPower with one source down = %v, %v, want the other two sites", power, err)
+	}
+	series, err := source.PowerSeries(ctx, "", now.Add(-time.Minute), now, time.Minute)
+	if err != nil || len(series) != 2 {
+		t.Errorf("PowerSeries with one source down = %v, %v, want the other two sites", series, err)
+	}
+	// the failing source's sites are the ones it last had
+	sites, _, err = source.(SiteDiscoverer).DiscoverSites(ctx)
+	if err != nil || len(sites) != 3 {
+		t.Errorf("DiscoverSites with one source down = %v, %v, want all three sites", sites, err)
+	}
+
+	prometheus.down = false
+	if power, err = source.CurrentPower(ctx, "", now.Add(-time.Minute), now); err != nil || len(power) != 3 {
+		t.Errorf("CurrentPower after recovering = %v, %v, want all three sites", power, err)
+	}
+}
+
+func TestMergeSourcesAllDown(t *testing.T) {
+	a := &brokenSource{MemorySource: NewMemorySource(), down: true}
+	b := &brokenSource{MemorySource: NewMemorySource(), down: true}
+	source := MergeSources(a, b)
+	if _, err := source.CurrentPower(context.Background(), "", time.Now().Add(-time.Minute), time.Now()); !errors.Is(err, errDown) {
+		t.Errorf("CurrentPower with every source down = %v, want the error", err)
+	}
+	if _, _, err := source.(SiteDiscoverer).DiscoverSites(context.Background()); !errors.Is(err, errDown) {
+		t.Errorf("DiscoverSites with every source down = %v, want the error", err)
+	}
+}
+
+func TestMergeSourcesDiscovery(t *testing.T) {
+	// a source that can't list its sites, as InfluxDB can't
+	quiet := struct{ DataSource }{NewMemorySource()}
+
+	if _, ok := MergeSources(NewMemorySource(), NewMemorySource()).(SiteDiscoverer); !ok {
+		t.Error("sources that all discover their sites merged into one that doesn't")
+	}
+	if _, ok := MergeSources(quiet, NewMemorySource()).(SiteDiscoverer); ok {
+		t.Error("merging a source that can't discover its sites gave one that claims to")
+	}
+	if _, ok := MergeSources(MergeSources(NewMemorySource(), quiet), NewMemorySource()).(SiteDiscoverer); ok {
+		t.Error("merging in a merge with a source that can't discover its sites gave one that claims to")
+	}
+	if _, ok := MergeSources(NewMemorySource(), quiet).(Collector); !ok {
+		t.Error("a merged source that can't discover its sites stopped collecting")
+	}
+}
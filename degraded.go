@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+)
+
+// EventError is sent on every stream, whatever types it asked for, when
+// fresh data couldn't be fetched.
+const EventError = "error"
+
+// UpstreamError says why the feed is running on stale data.
+type UpstreamError struct {
+	Time    int64  `json:"time"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	Since   int64  `json:"since"`         // when fetching started failing
+	Age     int64  `json:"age,omitempty"` // age of the last good data in milliseconds
+}
+
+// upstreamFailure turns a fetch error into a reason for clients to act on
+// and a message for people. The error itself stays in the logs, as it can
+// name internal hosts.
+func upstreamFailure(err error) (reason string, message string) {
+	var netErr net.Error
+	var queryErr *QueryError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		return "upstream_unavailable", "The data source is down; retrying shortly"
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return "upstream_timeout", "The data source took too long to answer"
+	case errors.As(err, &netErr):
+		return "upstream_unreachable", "The data source could not be reached"
+	case errors.As(err, &queryErr):
+		return "upstream_query_failed", "The data source could not run a query"
+	case errors.As(err, &syntaxErr) || errors.As(err, &typeErr):
+		return "upstream_bad_response", "The data source sent a response that could not be read"
+	}
+	return "upstream_error", "Live data could not be fetched"
+}
+
+// newDegradedEvent re-sends state, the last good data marked stale, along
+// with problem, the encoded UpstreamError.
+func newDegradedEvent(id uint64, state SolarData, problem []byte, filter Filter) (ev HubEvent, err error) {
+	ev = HubEvent{ID: id, State: filter.apply(state), Error: problem, prev: state, filter: filter, views: &viewCache{}}
+	if state.Time == 0 {
+		// nothing good to re-send yet
+		return ev, nil
+	}
+	ev.Snapshot, err = filter.marshal(ev.State)
+	return ev, err
+}
+
+// ErrorEvent is the error event for a degraded update, or nil.
+func (ev HubEvent) ErrorEvent() *Event {
+	if ev.Error == nil {
+		return nil
+	}
+	return &Event{ID: ev.id(), Event: []byte(EventError), Data: ev.Error}
+}
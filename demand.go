@@ -0,0 +1,24 @@
+package main
+
+import "time"
+
+// averageDemandMW is the islands' average electricity demand in megawatts at
+// each half hour of the day, from 00:00 to 24:00, as used by the dashboard's
+// demand chart (ios-gridwatch/src/averageDay.js).
+var averageDemandMW = [49]float64{
+	1.797, 1.893, 1.848, 1.802, 1.686, 1.6, 1.552, 1.53,
+	1.646, 1.701, 1.692, 1.712, 1.792, 1.913, 2.059, 2.272,
+	2.426, 2.481, 2.409, 2.308, 2.211, 2.113, 2.055, 2.035,
+	2.042, 2.016, 1.954, 1.913, 1.873, 1.838, 1.834, 1.868,
+	1.99, 2.233, 2.48, 2.694, 2.759, 2.719, 2.637, 2.539,
+	2.427, 2.308, 2.177, 2.055, 2.016, 1.933, 1.772, 1.67,
+	1.797,
+}
+
+// AverageDemandMW interpolates the average demand at the time of day of t.
+func AverageDemandMW(t time.Time) float64 {
+	minutes := float64(t.Hour()*60+t.Minute()) + float64(t.Second())/60
+	i := int(minutes / 30)
+	frac := (minutes - float64(i*30)) / 30
+	return averageDemandMW[i] + frac*(averageDemandMW[i+1]-averageDemandMW[i])
+}
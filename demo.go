@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// demoSites stand in for the registry when it lists no sites.
+var demoSites = []string{"Airport", "Holy Vale", "Porthmellon", "Tresco Abbey"}
+
+// demoStep is how often the demo meters are read.
+const demoStep = time.Minute
+
+// DemoSource makes up readings for demonstrations and development. Each
+// site's output follows the sun at its location, dimmed by clouds that
+// drift over all the islands at once with some local variation. Readings
+// depend only on the time, so every query agrees with every other.
+type DemoSource struct {
+	sites  []demoSite
+	origin time.Time // where the meters start counting, midnight UTC
+
+	mu   sync.Mutex
+	days map[demoDayKey]demoDay
+}
+
+type demoSite struct {
+	name     string
+	location Coordinates
+	capacity float64 // watts at full sun
+	base     float64 // meter reading at origin, kWh
+	seed     uint64
+}
+
+type demoDayKey struct {
+	site int
+	day  int
+}
+
+// demoDay is a site's energy and peak power over one UTC day.
+type demoDay struct {
+	energy float64
+	peak   float64
+}
+
+// NewDemoSource makes up a site for each in the registry, or a few if it
+// is empty. The meters start at the beginning of last year.
+func NewDemoSource(registry *SiteRegistry) *DemoSource {
+	var sites []demoSite
+	add := func(name string, location *Coordinates) {
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		seed := h.Sum64()
+		site := demoSite{
+			name:     name,
+			location: defaultCoordinates,
+			capacity: 5000 + 45000*unitNoise(seed, 1),
+			base:     1000 + 9000*unitNoise(seed, 2),
+			seed:     seed,
+		}
+		if location != nil {
+			site.location = *location
+		}
+		sites = append(sites, site)
+	}
+	for _, site := range registry.Sites {
+		add(site.Name, site.Location)
+	}
+	if len(sites) == 0 {
+		for _, name := range demoSites {
+			add(name, nil)
+		}
+	}
+	now := time.Now().UTC()
+	return &DemoSource{
+		sites:  sites,
+		origin: time.Date(now.Year()-1, 1, 1, 0, 0, 0, 0, time.UTC),
+		days:   map[demoDayKey]demoDay{},
+	}
+}
+
+func (s *DemoSource) MeterReadings(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return s.readings(site, start, end, func(i int) float64 { return s.meter(i, end) }), nil
+}
+
+func (s *DemoSource) CurrentPower(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return s.readings(site, start, end, func(i int) float64 { return s.power(i, end.Truncate(demoStep)) }), nil
+}
+
+func (s *DemoSource) Energy(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return s.readings(site, start, end, func(i int) float64 { return s.energy(i, start, end) }), nil
+}
+
+func (s *DemoSource) PeakPower(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return s.readings(site, start, end, func(i int) float64 { return s.peak(i, start, end) }), nil
+}
+
+func (s *DemoSource) PowerSeries(ctx context.Context, site string, start, end time.Time, step time.Duration) (Series, error) {
+	series := Series{}
+	for i := range s.sites {
+		if site != "" && s.sites[i].name != site {
+			continue
+		}
+		for t := start; !t.After(end); t = t.Add(step) {
+			if t.Add(-step).Before(s.origin) {
+				continue
+			}
+			// the average power is the energy over the step
+			watts := s.energy(i, t.Add(-step), t) * 1000 / step.Hours()
+			series[s.sites[i].name] = append(series[s.sites[i].name], Point{Time: t, Value: math.Round(watts*10) / 10})
+		}
+	}
+	return series, nil
+}
+
+// readings calls value for each site asked for that has a reading in the
+// range.
+func (s *DemoSource) readings(site string, start, end time.Time, value func(i int) float64) Readings {
+	readings := Readings{}
+	if !end.Truncate(demoStep).After(start) || end.Before(s.origin) {
+		return readings
+	}
+	for i := range s.sites {
+		if site == "" || s.sites[i].name == site {
+			readings[s.sites[i].name] = value(i)
+		}
+	}
+	return readings
+}
+
+// power is the output of site i at t in watts.
+func (s *DemoSource) power(i int, t time.Time) float64 {
+	site := s.sites[i]
+	elevation := solarElevation(t, site.location)
+	if elevation <= 0 {
+		return 0
+	}
+	clear := site.capacity * math.Pow(math.Sin(elevation*math.Pi/180), 1.2)
+
+	// weather comes in over hours and is shared by every site, showers
+	// pass in minutes and are more local
+	minutes := float64(t.Unix()) / 60
+	cover := 0.6*smoothNoise(1, minutes/240) + 0.25*smoothNoise(2, minutes/45) + 0.15*smoothNoise(site.seed, minutes/8)
+	cover = math.Max(0, cover-0.25) / 0.75
+	// to a tenth of a watt, as the meters read
+	return math.Round(clear*(1-0.85*cover*cover)*10) / 10
+}
+
+// meter is the meter reading of site i at the last reading at or before t.
+func (s *DemoSource) meter(i int, t time.Time) float64 {
+	return s.sites[i].base + s.energy(i, s.origin, t)
+}
+
+// energy is what site i's meter counted after start up to end, in kWh.
+func (s *DemoSource) energy(i int, start, end time.Time) (energy float64) {
+	s.walk(i, start, end, func(day demoDay) { energy += day.energy }, func(watts float64) { energy += watts * demoStep.Hours() / 1000 })
+	return energy
+}
+
+// peak is the highest reading of site i after start up to end.
+func (s *DemoSource) peak(i int, start, end time.Time) (peak float64) {
+	s.walk(i, start, end, func(day demoDay) { peak = math.Max(peak, day.peak) }, func(watts float64) { peak = math.Max(peak, watts) })
+	return peak
+}
+
+// walk goes through site i's readings after start up to end, from the
+// origin on, calling day with the totals of each whole UTC day in range
+// and reading with each reading outside them.
+func (s *DemoSource) walk(i int, start, end time.Time, day func(demoDay), reading func(watts float64)) {
+	if start.Before(s.origin) {
+		start = s.origin
+	}
+	end = end.Truncate(demoStep)
+	for t := start.Truncate(demoStep); t.Before(end); {
+		d := s.dayOf(t)
+		midnight := s.origin.Add(time.Duration(d) * 24 * time.Hour)
+		next := midnight.Add(24 * time.Hour)
+		if t.Equal(midnight) && !next.After(end) {
+			day(s.day(i, d))
+			t = next
+			continue
+		}
+		t = t.Add(demoStep)
+		reading(s.power(i, t))
+	}
+}
+
+// dayOf is the number of the UTC day t falls in, counting from the origin.
+func (s *DemoSource) dayOf(t time.Time) int {
+	offset := t.Sub(s.origin)
+	d := offset / (24 * time.Hour)
+	if offset%(24*time.Hour) < 0 {
+		d-- // round down before the origin, not towards it
+	}
+	return int(d)
+}
+
+// day sums up site i's readings after midnight on day d up to the next
+// midnight, remembering the result.
+func (s *DemoSource) day(i int, d int) demoDay {
+	s.mu.Lock()
+	totals, ok := s.days[demoDayKey{i, d}]
+	s.mu.Unlock()
+	if ok {
+		return totals
+	}
+	midnight := s.origin.Add(time.Duration(d) * 24 * time.Hour)
+	for t := midnight.Add(demoStep); !t.After(midnight.Add(24 * time.Hour)); t = t.Add(demoStep) {
+		watts := s.power(i, t)
+		totals.energy += watts * demoStep.Hours() / 1000
+		totals.peak = math.Max(totals.peak, watts)
+	}
+	s.mu.Lock()
+	s.days[demoDayKey{i, d}] = totals
+	s.mu.Unlock()
+	return totals
+}
+
+// smoothNoise is noise between 0 and 1 that varies smoothly with x, about
+// once per unit.
+func smoothNoise(seed uint64, x float64) float64 {
+	i := math.Floor(x)
+	f := x - i
+	f = f * f * (3 - 2*f)
+	a := unitNoise(seed, uint64(int64(i)))
+	b := unitNoise(seed, uint64(int64(i)+1))
+	return a + f*(b-a)
+}
+
+// unitNoise hashes seed and n to a number between 0 and 1.
+func unitNoise(seed uint64, n uint64) float64 {
+	// splitmix64
+	z := seed + n*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return float64(z>>11) / (1 << 53)
+}
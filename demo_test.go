@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDemoSourceSums(t *testing.T) {
+	ctx := context.Background()
+	s := NewDemoSource(&SiteRegistry{})
+	site := s.sites[0].name
+	// across a midnight, so that both whole days and odd minutes count
+	start := s.origin.Add(40*24*time.Hour - 90*time.Minute + 30*time.Second)
+	end := start.Add(50 * time.Hour)
+
+	var energy, peak float64
+	for m := start.Truncate(demoStep).Add(demoStep); !m.After(end); m = m.Add(demoStep) {
+		energy += s.power(0, m) * demoStep.Hours() / 1000
+		peak = math.Max(peak, s.power(0, m))
+	}
+	got, _ := s.Energy(ctx, site, start, end)
+	if math.Abs(got[site]-energy) > 1e-6 {
+		t.Errorf("Energy = %v, want %v", got[site], energy)
+	}
+	if got, _ := s.MeterReadings(ctx, site, start, end); math.Abs(got[site]-s.meter(0, start)-energy) > 1e-6 {
+		t.Errorf("meter went up by %v, want %v", got[site]-s.meter(0, start), energy)
+	}
+	if got, _ := s.PeakPower(ctx, site, start, end); got[site] != peak {
+		t.Errorf("PeakPower = %v, want %v", got[site], peak)
+	}
+}
+
+func TestDemoSourceBeforeOrigin(t *testing.T) {
+	ctx := context.Background()
+	s := NewDemoSource(&SiteRegistry{})
+	site := s.sites[0].name
+	end := s.origin.Add(3 * 24 * time.Hour)
+
+	// a century back costs no more than from the origin, and counts nothing
+	// from before it
+	long := time.Now()
+	energy, _ := s.Energy(ctx, site, end.Add(-36500*24*time.Hour), end)
+	peak, _ := s.PeakPower(ctx, site, end.Add(-36500*24*time.Hour), end)
+	if took := time.Since(long); took > 5*time.Second {
+		t.Errorf("a century took %v", took)
+	}
+	fromOrigin, _ := s.Energy(ctx, site, s.origin, end)
+	peakFromOrigin, _ := s.PeakPower(ctx, site, s.origin, end)
+	if energy[site] != fromOrigin[site] || peak[site] != peakFromOrigin[site] {
+		t.Errorf("from a century back = %v, %v, want %v, %v from the origin", energy[site], peak[site], fromOrigin[site], peakFromOrigin[site])
+	}
+
+	if got := s.dayOf(s.origin.Add(-time.Minute)); got != -1 {
+		t.Errorf("dayOf a minute before the origin = %d, want -1", got)
+	}
+	if got := s.dayOf(s.origin.Add(24*time.Hour - time.Minute)); got != 0 {
+		t.Errorf("dayOf a minute before the first midnight = %d, want 0", got)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SiteDiscoverer is a DataSource that can list its sites without reading
+// them, so that a site is known before its first reading and after its
+// last.
+type SiteDiscoverer interface {
+	// DiscoverSites lists every site with a series, and the labels of
+	// any series that can't be told apart from the others by site.
+	DiscoverSites(ctx context.Context) (sites []string, unknown []map[string]string, err error)
+}
+
+// DiscoveryReport is the outcome of the latest discovery, reconciled
+// against the site registry.
+type DiscoveryReport struct {
+	Time         int64               `json:"time"` // unix milliseconds, 0 before the first discovery
+	Sites        []string            `json:"sites"`
+	Unregistered []string            `json:"unregistered"` // with series but not in the registry
+	Missing      []string            `json:"missing"`      // in the registry without series
+	Discovered   []string            `json:"discovered"`   // found since the discovery before
+	Unknown      []map[string]string `json:"unknown_series"`
+	Error        string              `json:"error,omitempty"`
+}
+
+// Discovery keeps the list of sites up to date by asking the data source
+// for them every so often, logging whatever changes.
+type Discovery struct {
+	source   SiteDiscoverer
+	registry *SiteRegistry
+
+	mu     sync.RWMutex
+	report DiscoveryReport
+}
+
+func NewDiscovery(source SiteDiscoverer, registry *SiteRegistry) *Discovery {
+	return &Discovery{source: source, registry: registry}
+}
+
+// Run discovers the sites straight away and then every interval until ctx
+// is done.
+func (d *Discovery) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		d.Refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh discovers the sites once. A failed discovery keeps the sites
+// found before and records the error.
+func (d *Discovery) Refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	sites, unknown, err := d.source.DiscoverSites(ctx)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		slog.Error("site discovery failed", "err", err)
+		d.report.Error = err.Error()
+		return err
+	}
+	slices.Sort(sites)
+	sites = slices.Compact(sites)
+
+	prev := d.report
+	report := DiscoveryReport{Time: time.Now().UnixMilli(), Sites: sites, Unknown: unknown}
+	if prev.Time != 0 {
+		report.Discovered = without(sites, prev.Sites)
+	}
+	// with nothing registered every site would be unregistered, which
+	// says nothing
+	if len(d.registry.Sites) > 0 {
+		var registered []string
+		for _, site := range d.registry.Sites {
+			registered = append(registered, site.Name)
+		}
+		report.Unregistered = without(sites, registered)
+		report.Missing = without(registered, sites)
+	}
+	d.report = report
+
+	if prev.Time == 0 {
+		slog.Info("discovered sites", "sites", len(sites), "unregistered", report.Unregistered, "missing", report.Missing, "unknown_series", len(unknown))
+		return nil
+	}
+	for _, site := range report.Discovered {
+		slog.Info("new site discovered", "site", site, "registered", !slices.Contains(report.Unregistered, site))
+	}
+	for _, site := range without(report.Missing, prev.Missing) {
+		slog.Warn("registered site has no series", "site", site)
+	}
+	if len(unknown) != len(prev.Unknown) {
+		slog.Warn("series without a site", "count", len(unknown), "series", unknown)
+	}
+	return nil
+}
+
+// Report returns the latest discovery.
+func (d *Discovery) Report() DiscoveryReport {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.report
+}
+
+// Sites returns the sites found by the latest discovery that worked.
+func (d *Discovery) Sites() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.report.Sites
+}
+
+// without returns the names in a that aren't in b.
+func without(a []string, b []string) (names []string) {
+	for _, name := range a {
+		if !slices.Contains(b, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the typed events a stream can ask for with ?events=.
+const (
+	EventSnapshot = "snapshot"
+	EventSite     = "site"
+	EventTotals   = "totals"
+	EventDemand   = "demand"
+	EventAlert    = "alert"
+)
+
+// unmonitoredSite is the name of the estimated site get_solar_data adds.
+const unmonitoredSite = "Unmonitored (estimated)"
+
+// EventTypes is the set of typed events a stream wants. A nil set means the
+// client wants the original unnamed message carrying the full state.
+type EventTypes map[string]bool
+
+// ParseEventTypes reads a comma separated list of event names. An empty
+// list asks for every type.
+func ParseEventTypes(list string) (EventTypes, error) {
+	types := EventTypes{}
+	for _, name := range splitList(list) {
+		switch name {
+		case EventSnapshot, EventSite, EventTotals, EventDemand, EventAlert:
+			types[name] = true
+		default:
+			return nil, fmt.Errorf("unknown event type %q", name)
+		}
+	}
+	if len(types) == 0 {
+		for _, name := range []string{EventSnapshot, EventSite, EventTotals, EventDemand, EventAlert} {
+			types[name] = true
+		}
+	}
+	return types, nil
+}
+
+type Totals struct {
+	Time     int64   `json:"time"`
+	TotalKWh float32 `json:"total_kwh"`
+	DayKWh   float32 `json:"day_kwh"`
+	WeekKWh  float32 `json:"week_kwh"`
+	YearKWh  float32 `json:"year_kwh"`
+	CurrentW float32 `json:"current_w"`
+}
+
+func totalsOf(data SolarData) Totals {
+	return Totals{
+		Time:     data.Time,
+		TotalKWh: data.Total_kwh,
+		DayKWh:   data.Day_kwh,
+		WeekKWh:  data.Week_kwh,
+		YearKWh:  data.Year_kwh,
+		CurrentW: data.Current_w,
+	}
+}
+
+// SiteChanges carries only the sites whose values changed since the
+// previous update.
+type SiteChanges struct {
+	Time  int64      `json:"time"`
+	Sites []SiteData `json:"sites"`
+}
+
+// Demand compares live generation with the islands' average demand for the
+// time of day.
+type Demand struct {
+	Time        int64   `json:"time"`
+	AverageMW   float64 `json:"average_mw"`
+	GenerationW float32 `json:"generation_w"`
+	Percent     float64 `json:"percent"`
+}
+
+func demandOf(data SolarData) Demand {
+	average := AverageDemandMW(time.UnixMilli(data.Time))
+	return Demand{
+		Time:        data.Time,
+		AverageMW:   average,
+		GenerationW: data.Current_w,
+		Percent:     float64(data.Current_w) / (average * 1e6) * 100,
+	}
+}
+
+// Alert reports something notable about a site between two updates.
+type Alert struct {
+	Time    int64  `json:"time"`
+	Kind    string `json:"kind"`
+	Site    string `json:"site"`
+	Message string `json:"message"`
+}
+
+// alertsBetween compares consecutive states for sites disappearing,
+// reappearing or beating their previous peak.
+func alertsBetween(prev SolarData, next SolarData) (alerts []Alert) {
+	if prev.Time == 0 {
+		return nil
+	}
+	before := map[string]SiteData{}
+	for _, site := range prev.Sites {
+		before[site.Name] = site
+	}
+	after := map[string]bool{}
+	for _, site := range next.Sites {
+		after[site.Name] = true
+		if site.Name == unmonitoredSite {
+			continue
+		}
+		old, ok := before[site.Name]
+		switch {
+		case !ok:
+			alerts = append(alerts, Alert{Time: next.Time, Kind: "site_online", Site: site.Name, Message: site.Name + " is reporting"})
+		case old.Max > 0 && site.Snapshot > old.Max:
+			alerts = append(alerts, Alert{Time: next.Time, Kind: "new_peak", Site: site.Name, Message: fmt.Sprintf("%s reached a new peak of %.0fW", site.Name, site.Snapshot)})
+		}
+	}
+	for _, site := range prev.Sites {
+		if !after[site.Name] && site.Name != unmonitoredSite {
+			alerts = append(alerts, Alert{Time: next.Time, Kind: "site_offline", Site: site.Name, Message: site.Name + " has stopped reporting"})
+		}
+	}
+	return alerts
+}
+
+// changedSites returns the sites in next that differ from prev, ignoring
+// their order.
+func changedSites(prev SolarData, next SolarData) (changed []SiteData) {
+	before := map[string]SiteData{}
+	for _, site := range prev.Sites {
+		before[site.Name] = site
+	}
+	for _, site := range next.Sites {
+		if old, ok := before[site.Name]; !ok || old != site {
+			changed = append(changed, site)
+		}
+	}
+	return changed
+}
+
+// newHubEvent works out what changed between two states, as seen through
+// filter, and encodes every payload once, to be shared by all streams with
+// that filter.
+func newHubEvent(id uint64, prev SolarData, next SolarData, filter Filter) (ev HubEvent, err error) {
+	ev = HubEvent{ID: id, State: filter.apply(next), prev: prev, filter: filter, views: &viewCache{}}
+
+	// demand is for the islands as a whole, whatever the stream selected
+	if ev.Demand, err = json.Marshal(demandOf(next)); err != nil {
+		return ev, err
+	}
+	prev, next = filter.apply(prev), ev.State
+
+	if ev.Snapshot, err = filter.marshal(next); err != nil {
+		return ev, err
+	}
+	if changed := changedSites(prev, next); len(changed) > 0 {
+		if ev.Sites, err = filter.marshal(SiteChanges{Time: next.Time, Sites: changed}); err != nil {
+			return ev, err
+		}
+	}
+	totals, before := totalsOf(next), totalsOf(prev)
+	before.Time = totals.Time
+	if totals != before {
+		if ev.Totals, err = filter.marshal(totals); err != nil {
+			return ev, err
+		}
+	}
+	for _, alert := range alertsBetween(prev, next) {
+		data, err := json.Marshal(alert)
+		if err != nil {
+			return ev, err
+		}
+		ev.Alerts = append(ev.Alerts, data)
+	}
+	return ev, nil
+}
+
+// viewCache holds the filtered forms of an update, built the first time a
+// stream with each filter needs them.
+type viewCache struct {
+	mu    sync.Mutex
+	views map[string]HubEvent
+}
+
+// View returns the update as seen by streams with filter. The payloads are
+// encoded once per filter and shared by every stream using it.
+func (ev HubEvent) View(filter Filter) (HubEvent, error) {
+	if filter.IsZero() || ev.views == nil {
+		return ev, nil
+	}
+	ev.views.mu.Lock()
+	defer ev.views.mu.Unlock()
+	if view, ok := ev.views.views[filter.Key()]; ok {
+		return view, nil
+	}
+	var view HubEvent
+	var err error
+	if ev.Error != nil {
+		view, err = newDegradedEvent(ev.ID, ev.prev, ev.Error, filter)
+	} else {
+		view, err = newHubEvent(ev.ID, ev.prev, ev.State, filter)
+	}
+	if err != nil {
+		return view, err
+	}
+	view.views = nil
+	if ev.views.views == nil {
+		ev.views.views = map[string]HubEvent{}
+	}
+	ev.views.views[filter.Key()] = view
+	return view, nil
+}
+
+func (ev HubEvent) id() []byte {
+	return []byte(strconv.FormatUint(ev.ID, 10))
+}
+
+// Message is the unnamed event carrying the full state, as sent to clients
+// that did not ask for typed events.
+func (ev HubEvent) Message() *Event {
+	return &Event{ID: ev.id(), Data: ev.Snapshot}
+}
+
+// SnapshotEvent carries the full state for a typed stream.
+func (ev HubEvent) SnapshotEvent() *Event {
+	return &Event{ID: ev.id(), Event: []byte(EventSnapshot), Data: ev.Snapshot}
+}
+
+// Initial returns the events that bring a new typed stream up to date: the
+// snapshot if it asked for one, otherwise the full current value of each
+// type it wants.
+func (ev HubEvent) Initial(types EventTypes) (events []*Event, err error) {
+	if types[EventSnapshot] {
+		return []*Event{ev.SnapshotEvent()}, nil
+	}
+	add := func(name string, value any) error {
+		if !types[name] {
+			return nil
+		}
+		data, err := ev.filter.marshal(value)
+		if err != nil {
+			return err
+		}
+		events = append(events, &Event{ID: ev.id(), Event: []byte(name), Data: data})
+		return nil
+	}
+	if ev.filter.wantsTotals() {
+		if err := add(EventTotals, totalsOf(ev.State)); err != nil {
+			return nil, err
+		}
+	}
+	if err := add(EventSite, SiteChanges{Time: ev.State.Time, Sites: ev.State.Sites}); err != nil {
+		return nil, err
+	}
+	// demand was worked out from the unfiltered state; ev.State may be
+	// missing sites
+	if types[EventDemand] && ev.Demand != nil {
+		events = append(events, &Event{ID: ev.id(), Event: []byte(EventDemand), Data: ev.Demand})
+	}
+	return events, nil
+}
+
+// Changes returns the typed events for this update that types asks for.
+// Every event in an update shares its ID, so a client resumes after the
+// whole update.
+func (ev HubEvent) Changes(types EventTypes) (events []*Event) {
+	add := func(name string, data []byte) {
+		if types[name] && data != nil {
+			events = append(events, &Event{ID: ev.id(), Event: []byte(name), Data: data})
+		}
+	}
+	add(EventTotals, ev.Totals)
+	add(EventSite, ev.Sites)
+	add(EventDemand, ev.Demand)
+	for _, alert := range ev.Alerts {
+		add(EventAlert, alert)
+	}
+	return events
+}
+
+// describeTypes lists types for logging.
+func describeTypes(types EventTypes) string {
+	if types == nil {
+		return "message"
+	}
+	return strings.Join(slices.Sorted(maps.Keys(types)), ",")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSource serves readings from a file in InfluxDB line protocol, laid
+// out as InfluxSource expects them:
+//
+//	total_act_power,purpose=solar,site=Holy\ Vale value=1534.2 1718971200000000000
+//	total_import,purpose=solar,site=Holy\ Vale value=10234.7 1718971200000000000
+//
+// Timestamps are in nanoseconds and lines for other measurements, or that
+// the schema's matchers don't select, are ignored. The file is read again
+// whenever it changes.
+type FileSource struct {
+	path   string
+	field  string
+	schema MetricSchema
+
+	mu      sync.Mutex
+	modTime time.Time
+	mem     *MemorySource
+}
+
+func NewFileSource(path string, field string, schema MetricSchema) (*FileSource, error) {
+	s := &FileSource{path: path, field: field, schema: schema}
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSource) MeterReadings(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	mem, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return mem.MeterReadings(ctx, site, start, end)
+}
+
+func (s *FileSource) CurrentPower(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	mem, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return mem.CurrentPower(ctx, site, start, end)
+}
+
+func (s *FileSource) Energy(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	mem, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return mem.Energy(ctx, site, start, end)
+}
+
+func (s *FileSource) PowerSeries(ctx context.Context, site string, start, end time.Time, step time.Duration) (Series, error) {
+	mem, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return mem.PowerSeries(ctx, site, start, end, step)
+}
+
+func (s *FileSource) PeakPower(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	mem, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return mem.PeakPower(ctx, site, start, end)
+}
+
+func (s *FileSource) DiscoverSites(ctx context.Context) ([]string, []map[string]string, error) {
+	mem, err := s.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	return mem.DiscoverSites(ctx)
+}
+
+// load returns the file's readings, reading it again if it has changed.
+func (s *FileSource) load() (*MemorySource, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if s.mem != nil && info.ModTime().Equal(s.modTime) {
+		return s.mem, nil
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mem := NewMemorySource()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if err := addLineProtocol(mem, scanner.Text(), s.field, s.schema); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", s.path, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	s.mem, s.modTime = mem, info.ModTime()
+	return mem, nil
+}
+
+// addLineProtocol adds the reading on one line of line protocol, if it is
+// one of ours.
+func addLineProtocol(mem *MemorySource, line string, field string, schema MetricSchema) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	sections := splitLineProtocol(line, ' ')
+	if len(sections) != 3 {
+		return errors.New("want a measurement, fields and a timestamp")
+	}
+	key := splitLineProtocol(sections[0], ',')
+	var measure Measurement
+	switch unescapeLineProtocol(key[0]) {
+	case schema.Energy:
+		measure = MeasureMeter
+	case schema.Power:
+		measure = MeasurePower
+	default:
+		return nil
+	}
+	tags := map[string]string{}
+	for _, tag := range key[1:] {
+		name, value, ok := cutLineProtocol(tag)
+		if !ok {
+			return fmt.Errorf("bad tag %q", tag)
+		}
+		tags[name] = value
+	}
+	for _, m := range schema.Matchers {
+		if !m.Matches(tags[m.Label]) {
+			return nil
+		}
+	}
+	ns, err := strconv.ParseInt(sections[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad timestamp: %w", err)
+	}
+	for _, f := range splitLineProtocol(sections[1], ',') {
+		name, value, ok := cutLineProtocol(f)
+		if !ok {
+			return fmt.Errorf("bad field %q", f)
+		}
+		if name != field {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimRight(value, "iu"), 64)
+		if err != nil {
+			return fmt.Errorf("field %s is not a number", name)
+		}
+		mem.Add(tags[schema.SiteLabel], measure, Point{Time: time.Unix(0, ns), Value: v})
+	}
+	return nil
+}
+
+// splitLineProtocol splits s at each sep that isn't escaped or inside a
+// quoted string field.
+func splitLineProtocol(s string, sep byte) (parts []string) {
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"' && (quoted || i > 0 && s[i-1] == '='):
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// cutLineProtocol splits a tag or field into its unescaped name and value.
+func cutLineProtocol(s string) (name string, value string, ok bool) {
+	parts := splitLineProtocol(s, '=')
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", false
+	}
+	return unescapeLineProtocol(parts[0]), unescapeLineProtocol(parts[1]), true
+}
+
+var lineProtocolEscapes = strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\"`, `"`, `\\`, `\`)
+
+func unescapeLineProtocol(s string) string {
+	return lineProtocolEscapes.Replace(s)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// The per-site and total fields a stream can select with ?fields=.
+var (
+	siteFields  = []string{"snapshot", "today", "week", "year", "max"}
+	totalFields = []string{"total_kwh", "day_kwh", "week_kwh", "year_kwh", "current_w"}
+)
+
+// Filter narrows a live stream to some sites and fields. The zero Filter
+// passes everything through.
+type Filter struct {
+	Sites  []string // sorted, empty for every site
+	Fields []string // sorted, empty for every field
+}
+
+// ParseFilter builds a filter from the sites, groups and fields a client
+// asked for, expanding groups through registry.
+func ParseFilter(sites []string, groups []string, fields []string, registry *SiteRegistry) (Filter, error) {
+	var f Filter
+	f.Sites = append(f.Sites, sites...)
+	for _, group := range groups {
+		members := registry.Group(group)
+		if members == nil {
+			return Filter{}, fmt.Errorf("unknown site group %q", group)
+		}
+		f.Sites = append(f.Sites, members...)
+	}
+	for _, field := range fields {
+		if !slices.Contains(siteFields, field) && !slices.Contains(totalFields, field) {
+			return Filter{}, fmt.Errorf("unknown field %q", field)
+		}
+		f.Fields = append(f.Fields, field)
+	}
+	slices.Sort(f.Sites)
+	f.Sites = slices.Compact(f.Sites)
+	slices.Sort(f.Fields)
+	f.Fields = slices.Compact(f.Fields)
+	return f, nil
+}
+
+// FilterFromQuery reads the sites, groups and fields query parameters. Each
+// may be repeated or hold a comma separated list.
+func FilterFromQuery(query map[string][]string, registry *SiteRegistry) (Filter, error) {
+	list := func(name string) (items []string) {
+		for _, value := range query[name] {
+			items = append(items, splitList(value)...)
+		}
+		return items
+	}
+	return ParseFilter(list("sites"), list("groups"), list("fields"), registry)
+}
+
+func (f Filter) IsZero() bool {
+	return len(f.Sites) == 0 && len(f.Fields) == 0
+}
+
+// Key identifies the filter, so streams with the same filter share payloads.
+func (f Filter) Key() string {
+	return strings.Join(f.Sites, "\x00") + "\x01" + strings.Join(f.Fields, "\x00")
+}
+
+func (f Filter) allowsSite(name string) bool {
+	return len(f.Sites) == 0 || slices.Contains(f.Sites, name)
+}
+
+func (f Filter) allowsField(name string) bool {
+	return len(f.Fields) == 0 || slices.Contains(f.Fields, name)
+}
+
+// wantsTotals says whether the filter keeps any of the island totals.
+func (f Filter) wantsTotals() bool {
+	return slices.ContainsFunc(totalFields, f.allowsField)
+}
+
+// apply drops the sites the filter excludes and zeroes the fields it
+// excludes, so that comparing filtered states only sees selected changes.
+func (f Filter) apply(data SolarData) SolarData {
+	if f.IsZero() {
+		return data
+	}
+	filtered := data
+	filtered.Sites = nil
+	for _, site := range data.Sites {
+		if !f.allowsSite(site.Name) {
+			continue
+		}
+		if len(f.Fields) > 0 {
+			site = SiteData{
+				Name:     site.Name,
+				Snapshot: f.pick("snapshot", site.Snapshot),
+				Today:    f.pick("today", site.Today),
+				Week:     f.pick("week", site.Week),
+				Last_365: f.pick("year", site.Last_365),
+				Max:      f.pick("max", site.Max),
+			}
+		}
+		filtered.Sites = append(filtered.Sites, site)
+	}
+	if len(f.Fields) > 0 {
+		filtered.Total_kwh = float32(f.pick("total_kwh", float64(data.Total_kwh)))
+		filtered.Day_kwh = float32(f.pick("day_kwh", float64(data.Day_kwh)))
+		filtered.Week_kwh = float32(f.pick("week_kwh", float64(data.Week_kwh)))
+		filtered.Year_kwh = float32(f.pick("year_kwh", float64(data.Year_kwh)))
+		filtered.Current_w = float32(f.pick("current_w", float64(data.Current_w)))
+	}
+	return filtered
+}
+
+func (f Filter) pick(field string, value float64) float64 {
+	if f.allowsField(field) {
+		return value
+	}
+	return 0
+}
+
+// marshal encodes v as JSON, leaving out any field the filter excludes.
+func (f Filter) marshal(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(f.Fields) == 0 {
+		return data, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var tree any
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, err
+	}
+	f.prune(tree)
+	return json.Marshal(tree)
+}
+
+func (f Filter) prune(tree any) {
+	switch node := tree.(type) {
+	case map[string]any:
+		for key, value := range node {
+			if (slices.Contains(siteFields, key) || slices.Contains(totalFields, key)) && !f.allowsField(key) {
+				delete(node, key)
+				continue
+			}
+			f.prune(value)
+		}
+	case []any:
+		for _, value := range node {
+			f.prune(value)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A fixtures directory holds recorded answers, laid out as
+//
+//	live.jsonl           live states, one JSON SolarData per line, in order
+//	today.json           today's generation, as served on /site/all
+//	sites/<days>.json    every site's period, as served on /site/all/<days>
+//	site/<site>/<days>.json
+//	                     one site's period, named as in the URL
+//
+// Apart from live.jsonl each file holds a fixture, the answer with the time
+// it was recorded.
+type fixture[T any] struct {
+	Recorded int64 `json:"recorded"` // unix milliseconds
+	Data     T     `json:"data"`
+}
+
+// FixtureService replays a fixtures directory as if it were live. The
+// recorded live states play on a loop at the pace they were recorded,
+// and charts are moved forward by whole days so that they read as today.
+type FixtureService struct {
+	dir     string
+	live    []SolarData
+	started time.Time
+}
+
+func NewFixtureService(dir string) (*FixtureService, error) {
+	s := &FixtureService{dir: dir, started: time.Now()}
+	f, err := os.Open(filepath.Join(dir, "live.jsonl"))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		var state SolarData
+		if err := json.Unmarshal(scanner.Bytes(), &state); err != nil {
+			return nil, fmt.Errorf("live.jsonl:%d: %w", n, err)
+		}
+		s.live = append(s.live, state)
+	}
+	return s, scanner.Err()
+}
+
+// errPast is asking fixtures for a time other than now.
+var errPast = fmt.Errorf("fixtures only hold the present: %w", os.ErrNotExist)
+
+func (s *FixtureService) SolarData(ctx context.Context, at time.Time) (SolarData, error) {
+	if !at.IsZero() {
+		return SolarData{}, errPast
+	}
+	if len(s.live) == 0 {
+		return SolarData{}, fmt.Errorf("no live states in %s: %w", s.dir, os.ErrNotExist)
+	}
+	first, last := s.live[0].Time, s.live[len(s.live)-1].Time
+	// leave the average gap between the last state and the first again
+	loop := last - first
+	if len(s.live) > 1 {
+		loop += loop / int64(len(s.live)-1)
+	}
+	now := time.Now()
+	state := s.live[0]
+	if loop > 0 {
+		at := first + now.Sub(s.started).Milliseconds()%loop
+		for _, recorded := range s.live {
+			if recorded.Time > at {
+				break
+			}
+			state = recorded
+		}
+	}
+	state.Time = now.UnixMilli()
+	return state, nil
+}
+
+func (s *FixtureService) TodaysGeneration(ctx context.Context, at time.Time) (PeriodData, error) {
+	if !at.IsZero() {
+		return PeriodData{}, errPast
+	}
+	var today fixture[PeriodData]
+	if err := s.read("today.json", &today); err != nil {
+		return PeriodData{}, err
+	}
+	today.Data.Time = time.Now().UnixMilli()
+	today.Data.Values = shiftValues(today.Data.Values, today.Recorded)
+	if len(today.Data.Values) == 0 {
+		return PeriodData{}, errEmptyDataset
+	}
+	return today.Data, nil
+}
+
+func (s *FixtureService) SitePeriod(ctx context.Context, site string, days int, at time.Time) (SitePeriodData, error) {
+	if !at.IsZero() {
+		return SitePeriodData{}, errPast
+	}
+	var period fixture[SitePeriodData]
+	if err := s.read(filepath.Join("site", site, strconv.Itoa(days)+".json"), &period); err != nil {
+		return SitePeriodData{}, err
+	}
+	period.Data.Time = time.Now().UnixMilli()
+	period.Data.Data = shiftValues(period.Data.Data, period.Recorded)
+	return period.Data, nil
+}
+
+func (s *FixtureService) Period(ctx context.Context, days int, at time.Time) ([]SitePeriodData, error) {
+	if !at.IsZero() {
+		return nil, errPast
+	}
+	var period fixture[[]SitePeriodData]
+	if err := s.read(filepath.Join("sites", strconv.Itoa(days)+".json"), &period); err != nil {
+		return nil, err
+	}
+	for i := range period.Data {
+		period.Data[i].Time = time.Now().UnixMilli()
+		period.Data[i].Data = shiftValues(period.Data[i].Data, period.Recorded)
+	}
+	return period.Data, nil
+}
+
+func (s *FixtureService) read(name string, v any) error {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// shiftValues moves a chart recorded at recorded forward by whole days to
+// today, leaving out the points that are still to come.
+func shiftValues(values [][]interface{}, recorded int64) (shifted [][]interface{}) {
+	now := time.Now()
+	days := int(now.Sub(time.UnixMilli(recorded)).Hours() / 24)
+	for _, value := range values {
+		if len(value) < 2 {
+			continue
+		}
+		seconds, ok := value[0].(float64)
+		if !ok {
+			continue
+		}
+		t := time.UnixMilli(int64(seconds*1000)).AddDate(0, 0, days)
+		if t.After(now) {
+			break
+		}
+		shifted = append(shifted, []interface{}{float64(t.UnixMilli()) / 1000, value[1]})
+	}
+	return shifted
+}
+
+// dashboardPeriods are the periods, in days, the dashboard asks for.
+var dashboardPeriods = []int{1, 7, 31, 365}
+
+// recordingService passes answers through from another Service, saving
+// the successful ones about the present to a fixtures directory. Only the
+// periods the dashboard shows are saved, so that clients asking for others
+// can't fill the disk.
+type recordingService struct {
+	Service
+	dir string
+
+	mu sync.Mutex // serialises appends to live.jsonl
+}
+
+func NewRecordingService(service Service, dir string) (Service, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &recordingService{Service: service, dir: dir}, nil
+}
+
+func (s *recordingService) SolarData(ctx context.Context, at time.Time) (SolarData, error) {
+	state, err := s.Service.SolarData(ctx, at)
+	if err != nil || !at.IsZero() {
+		return state, err
+	}
+	line, err := json.Marshal(state)
+	if err == nil {
+		s.mu.Lock()
+		err = appendFile(filepath.Join(s.dir, "live.jsonl"), append(line, '\n'))
+		s.mu.Unlock()
+	}
+	s.failed("live.jsonl", err)
+	return state, nil
+}
+
+func (s *recordingService) TodaysGeneration(ctx context.Context, at time.Time) (PeriodData, error) {
+	today, err := s.Service.TodaysGeneration(ctx, at)
+	if err == nil && at.IsZero() {
+		s.failed("today.json", writeFixture(s.dir, "today.json", today))
+	}
+	return today, err
+}
+
+func (s *recordingService) SitePeriod(ctx context.Context, site string, days int, at time.Time) (SitePeriodData, error) {
+	period, err := s.Service.SitePeriod(ctx, site, days, at)
+	if err == nil && at.IsZero() && slices.Contains(dashboardPeriods, days) {
+		name := filepath.Join("site", site, strconv.Itoa(days)+".json")
+		s.failed(name, writeFixture(s.dir, name, period))
+	}
+	return period, err
+}
+
+func (s *recordingService) Period(ctx context.Context, days int, at time.Time) ([]SitePeriodData, error) {
+	period, err := s.Service.Period(ctx, days, at)
+	if err == nil && at.IsZero() && slices.Contains(dashboardPeriods, days) {
+		name := filepath.Join("sites", strconv.Itoa(days)+".json")
+		s.failed(name, writeFixture(s.dir, name, period))
+	}
+	return period, err
+}
+
+// failed logs a fixture that couldn't be saved. Recording is a side line,
+// so the answer still goes out.
+func (s *recordingService) failed(name string, err error) {
+	if err != nil {
+		slog.Warn("recording fixture failed", "dir", s.dir, "fixture", name, "err", err)
+	}
+}
+
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeFixture replaces the fixture name in dir, so that a replay never
+// sees a half-written file.
+func writeFixture[T any](dir string, name string, data T) error {
+	encoded, err := json.Marshal(fixture[T]{Recorded: time.Now().UnixMilli(), Data: data})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".fixture-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
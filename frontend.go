@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+//go:embed all:ios-gridwatch/dist
+var embeddedDist embed.FS
+
+// vite names bundled assets name-<hash>.ext, so their content never changes
+// under the same URL and they can be cached forever.
+var hashedAsset = regexp.MustCompile(`^assets/.+-[A-Za-z0-9_-]{8}\.(js|css)$`)
+
+// Frontend serves the built dashboard embedded in the binary.
+type Frontend struct {
+	files   fs.FS
+	etags   map[string]string
+	config  []byte
+	started time.Time
+}
+
+// FrontendConfig is exposed to the dashboard as window.GRIDWATCH_CONFIG.
+type FrontendConfig struct {
+	// Server is the base URL the dashboard uses for /sse and /site. An empty
+	// string means the same origin that served the page.
+	Server string `json:"server"`
+	// Poll is how often live data is polled, for the dashboard's countdown
+	// to the next update.
+	Poll FrontendPoll `json:"poll"`
+}
+
+type FrontendPoll struct {
+	DayMs   int64 `json:"day_ms"`
+	NightMs int64 `json:"night_ms"`
+}
+
+func NewFrontend(config FrontendConfig) (*Frontend, error) {
+	files, err := fs.Sub(embeddedDist, "ios-gridwatch/dist")
+	if err != nil {
+		return nil, err
+	}
+
+	etags := map[string]string{}
+	err = fs.WalkDir(files, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		etags[name] = `"` + base64.RawURLEncoding.EncodeToString(sum[:12]) + `"`
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	script := []byte("window.GRIDWATCH_CONFIG=" + string(configJSON) + ";\n")
+
+	return &Frontend{files: files, etags: etags, config: script, started: time.Now()}, nil
+}
+
+// Register adds the config endpoint and a catch-all route for the dashboard.
+// Routes registered elsewhere on e take precedence over the catch-all.
+func (f *Frontend) Register(e *echo.Echo) {
+	e.GET("/config.js", f.serveConfig)
+	e.GET("/*", f.serveFile)
+}
+
+func (f *Frontend) serveConfig(c echo.Context) error {
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	return c.Blob(http.StatusOK, "text/javascript; charset=utf-8", f.config)
+}
+
+func (f *Frontend) serveFile(c echo.Context) error {
+	name := strings.TrimPrefix(path.Clean("/"+c.Param("*")), "/")
+	if name == "" {
+		name = "index.html"
+	}
+
+	if _, ok := f.etags[name]; !ok {
+		// anything that looks like a file is a genuine miss, everything
+		// else is a client-side route and gets the app shell
+		if path.Ext(name) != "" {
+			return echo.ErrNotFound
+		}
+		name = "index.html"
+	}
+
+	data, err := fs.ReadFile(f.files, name)
+	if err != nil {
+		return err
+	}
+
+	w := c.Response()
+	switch {
+	case hashedAsset.MatchString(name):
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	case name == "index.html":
+		w.Header().Set("Cache-Control", "no-cache")
+	default:
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	w.Header().Set("ETag", f.etags[name])
+
+	http.ServeContent(w, c.Request(), name, f.started, bytes.NewReader(data))
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/subtle"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// CORSMiddleware applies one cross-origin policy to every response,
+// including errors and preflight requests, so handlers don't set it by hand.
+func CORSMiddleware(cfg CORSConfig) echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: cfg.AllowOrigins,
+		AllowMethods: cfg.AllowMethods,
+		MaxAge:       cfg.MaxAge,
+	})
+}
+
+// SecurityMiddleware adds the headers worth sending when gridwatch serves
+// the dashboard itself. HSTS is only sent on TLS requests.
+func SecurityMiddleware(cfg SecurityConfig, apiBase string) echo.MiddlewareFunc {
+	csp := cfg.CSP
+	if apiBase != "" && csp == defaultCSP {
+		// the dashboard needs to reach an API hosted on another origin
+		csp += " " + apiBase
+	}
+	return middleware.SecureWithConfig(middleware.SecureConfig{
+		ContentTypeNosniff:    "nosniff",
+		ContentSecurityPolicy: csp,
+		HSTSMaxAge:            cfg.HSTSMaxAge,
+	})
+}
+
+// AdminMiddleware lets through only requests with token as their bearer
+// token, comparing in constant time so the token can't be guessed from
+// how long a refusal takes.
+func AdminMiddleware(token string) echo.MiddlewareFunc {
+	return middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+	})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// clientBuffer is how many updates may queue for a stream before the client
+// is considered too slow and dropped.
+const clientBuffer = 16
+
+// fetchTimeout bounds each poll, so that a hung upstream is reported
+// rather than stalling the hub.
+const fetchTimeout = 30 * time.Second
+
+// HubEvent is one live update. The payloads for each kind of event are
+// encoded once when the update is published and shared by every stream.
+type HubEvent struct {
+	ID    uint64
+	State SolarData
+
+	Snapshot []byte
+	Sites    []byte // nil when no site changed
+	Totals   []byte // nil when the totals are unchanged
+	Demand   []byte
+	Alerts   [][]byte
+
+	// Error is the encoded UpstreamError when fresh data couldn't be
+	// fetched, in which case State is the last good data marked stale
+	Error []byte
+
+	prev   SolarData // unfiltered state before this update, or the stale state re-sent
+	filter Filter    // the filter State and the payloads were built for
+	views  *viewCache
+}
+
+// Hub polls for live data on behalf of every connected stream and fans each
+// update worth pushing out to them. Recent updates are kept so that a reconnecting client
+// can be sent what it missed.
+type Hub struct {
+	fetch  func(context.Context) (SolarData, error)
+	policy *PollPolicy
+	kick   chan struct{}
+
+	mu           sync.Mutex
+	lastID       uint64
+	lastAt       time.Time // when the latest update was pushed
+	polledAt     time.Time // when data was last fetched, pushed or not
+	lastGood     SolarData // the latest data fetched
+	lastGoodAt   time.Time // when it was fetched
+	failingSince time.Time // zero while fetching works
+	history      *eventRing
+	clients      map[chan HubEvent]struct{}
+}
+
+func NewHub(fetch func(context.Context) (SolarData, error), policy *PollPolicy, replay int) *Hub {
+	return &Hub{
+		fetch:   fetch,
+		policy:  policy,
+		kick:    make(chan struct{}, 1),
+		history: newEventRing(replay),
+		clients: map[chan HubEvent]struct{}{},
+	}
+}
+
+// Subscribe registers a stream. lastEventID is the ID the client last saw,
+// or "" on a fresh connection. The backlog must be sent before anything
+// read from updates; resumed says whether it holds the updates the client
+// missed rather than a starting state. updates is closed if the hub drops
+// the client.
+func (h *Hub) Subscribe(lastEventID string) (updates chan HubEvent, backlog []HubEvent, resumed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	updates = make(chan HubEvent, clientBuffer)
+	h.clients[updates] = struct{}{}
+
+	if id, err := strconv.ParseUint(lastEventID, 10, 64); err == nil {
+		if missed, ok := h.history.since(id); ok {
+			return updates, missed, true
+		}
+	}
+
+	// too far behind to replay, or new: start from the latest state if it
+	// is still current, otherwise fetch it now
+	if latest, ok := h.history.latest(); ok && time.Since(h.polledAt) < h.policy.Interval(time.Now()) {
+		return updates, []HubEvent{latest}, false
+	}
+	select {
+	case h.kick <- struct{}{}:
+	default:
+	}
+	return updates, nil, false
+}
+
+func (h *Hub) Unsubscribe(updates chan HubEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[updates]; ok {
+		delete(h.clients, updates)
+		close(updates)
+	}
+}
+
+// Run polls on the policy's schedule while there are clients, and straight
+// away when a new client needs data, until ctx is done.
+func (h *Hub) Run(ctx context.Context) {
+	timer := time.NewTimer(time.Until(h.policy.Next(time.Now())))
+	defer timer.Stop()
+
+	for {
+		force := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			timer.Reset(time.Until(h.policy.Next(time.Now())))
+			h.mu.Lock()
+			idle := len(h.clients) == 0
+			h.mu.Unlock()
+			if idle {
+				continue
+			}
+		case <-h.kick:
+			// the new client is waiting, so this update goes out even if
+			// nothing changed
+			force = true
+			timer.Reset(time.Until(h.policy.Next(time.Now())))
+		}
+		h.poll(ctx, force)
+	}
+}
+
+func (h *Hub) poll(ctx context.Context, force bool) {
+	var err error
+	ctx, span := tracer.Start(ctx, "SSE update", trace.WithNewRoot())
+	defer func() { endSpan(span, err) }()
+	logger := slog.Default().With("trace_id", span.SpanContext().TraceID().String())
+	ctx = WithLogger(ctx, logger)
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	solarData, err := h.fetch(ctx)
+	if err != nil {
+		logger.Error("SSE update failed", "err", err)
+		h.degrade(err)
+		return
+	}
+	if err = h.publish(solarData, force); err != nil {
+		logger.Error("SSE update failed", "err", err)
+		h.degrade(err)
+	}
+}
+
+// publish pushes state to every client, unless it is too close to the
+// previous update to be worth sending and force is false.
+func (h *Hub) publish(state SolarData, force bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	h.polledAt = now
+	h.lastGood, h.lastGoodAt = state, now
+	prev, _ := h.history.latest()
+	// the first good update after an outage always goes out, so that
+	// clients stop showing stale data
+	if !force && prev.Error == nil && !h.policy.Worth(prev.State, state, h.lastAt) {
+		return nil
+	}
+
+	ev, err := newHubEvent(h.nextID(now), prev.State, state, Filter{})
+	if err != nil {
+		return err
+	}
+	if !h.failingSince.IsZero() {
+		slog.Info("live data recovered", "outage", now.Sub(h.failingSince))
+		h.failingSince = time.Time{}
+	}
+	h.broadcast(ev, now)
+	return nil
+}
+
+// degrade keeps every stream open when fresh data couldn't be fetched,
+// sending why along with the last good data marked stale. A new client
+// joining meanwhile is given this rather than causing another fetch.
+func (h *Hub) degrade(cause error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	h.polledAt = now
+	if h.failingSince.IsZero() {
+		h.failingSince = now
+	}
+
+	state := h.lastGood
+	if state.Time != 0 {
+		state.Stale = true
+		state.Age = now.Sub(h.lastGoodAt).Milliseconds()
+	}
+	reason, message := upstreamFailure(cause)
+	problem, err := json.Marshal(UpstreamError{
+		Time:    now.UnixMilli(),
+		Reason:  reason,
+		Message: message,
+		Since:   h.failingSince.UnixMilli(),
+		Age:     state.Age,
+	})
+	if err != nil {
+		slog.Error("encoding upstream error failed", "err", err)
+		return
+	}
+	ev, err := newDegradedEvent(h.nextID(now), state, problem, Filter{})
+	if err != nil {
+		slog.Error("encoding stale data failed", "err", err)
+		return
+	}
+	h.broadcast(ev, now)
+}
+
+// nextID returns the ID for an update made at now. IDs are millisecond
+// timestamps so they keep increasing across restarts.
+func (h *Hub) nextID(now time.Time) uint64 {
+	id := uint64(now.UnixMilli())
+	if id <= h.lastID {
+		id = h.lastID + 1
+	}
+	return id
+}
+
+// broadcast records ev and queues it for every client.
+func (h *Hub) broadcast(ev HubEvent, now time.Time) {
+	h.lastID = ev.ID
+	h.lastAt = now
+	h.history.push(ev)
+
+	for updates := range h.clients {
+		select {
+		case updates <- ev:
+		default:
+			slog.Warn("dropping slow SSE client")
+			delete(h.clients, updates)
+			close(updates)
+		}
+	}
+}
+
+// eventRing keeps the most recent events in order.
+type eventRing struct {
+	events []HubEvent
+	start  int
+	count  int
+}
+
+func newEventRing(size int) *eventRing {
+	if size < 1 {
+		size = 1
+	}
+	return &eventRing{events: make([]HubEvent, size)}
+}
+
+func (r *eventRing) push(ev HubEvent) {
+	end := (r.start + r.count) % len(r.events)
+	r.events[end] = ev
+	if r.count < len(r.events) {
+		r.count++
+	} else {
+		r.start = (r.start + 1) % len(r.events)
+	}
+}
+
+func (r *eventRing) at(i int) HubEvent {
+	return r.events[(r.start+i)%len(r.events)]
+}
+
+func (r *eventRing) latest() (HubEvent, bool) {
+	if r.count == 0 {
+		return HubEvent{}, false
+	}
+	return r.at(r.count - 1), true
+}
+
+// since returns the events after id. ok is false when id is not in the
+// ring, so the client has missed more than can be replayed.
+func (r *eventRing) since(id uint64) (events []HubEvent, ok bool) {
+	for i := 0; i < r.count; i++ {
+		if r.at(i).ID == id {
+			for j := i + 1; j < r.count; j++ {
+				events = append(events, r.at(j))
+			}
+			return events, true
+		}
+	}
+	return nil, false
+}
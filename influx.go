@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InfluxSource queries InfluxDB 2 with Flux. Each metric is expected to be
+// its own measurement, tagged as the series are labelled in Prometheus,
+// with the reading in cfg.Field, any field if that is empty.
+type InfluxSource struct {
+	cfg    InfluxConfig
+	schema MetricSchema
+}
+
+func NewInfluxSource(cfg InfluxConfig, schema MetricSchema) *InfluxSource {
+	cfg.URL = strings.TrimSuffix(cfg.URL, "/")
+	return &InfluxSource{cfg: cfg, schema: schema}
+}
+
+func (s *InfluxSource) MeterReadings(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return s.readings(ctx, s.from(s.schema.Energy, site, start, end)+"\n  |> last()")
+}
+
+func (s *InfluxSource) CurrentPower(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return s.readings(ctx, s.from(s.schema.Power, site, start, end)+"\n  |> last()")
+}
+
+func (s *InfluxSource) Energy(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	// the meters only count up, so the spread is the last reading less
+	// the first
+	return s.readings(ctx, s.from(s.schema.Energy, site, start, end)+"\n  |> spread()")
+}
+
+func (s *InfluxSource) PeakPower(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return s.readings(ctx, s.from(s.schema.Power, site, start, end)+"\n  |> max()")
+}
+
+func (s *InfluxSource) PowerSeries(ctx context.Context, site string, start, end time.Time, step time.Duration) (Series, error) {
+	// each window is stamped with its end, as avg_over_time is in PromQL
+	query := s.from(s.schema.Power, site, start.Add(-step), end) +
+		fmt.Sprintf("\n  |> aggregateWindow(every: %s, fn: mean, createEmpty: false)", fluxDuration(step))
+	rows, err := s.query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	series := Series{}
+	for _, row := range rows {
+		series[row.site] = append(series[row.site], Point{Time: row.time, Value: row.value})
+	}
+	for _, points := range series {
+		slices.SortFunc(points, func(a, b Point) int { return a.Time.Compare(b.Time) })
+	}
+	return series, nil
+}
+
+// from selects metric for site, or for every site, from just after start
+// up to and including end, one table per site.
+func (s *InfluxSource) from(metric string, site string, start, end time.Time) string {
+	filters := []string{"r._measurement == " + fluxString(metric)}
+	if s.cfg.Field != "" {
+		filters = append(filters, "r._field == "+fluxString(s.cfg.Field))
+	}
+	for _, m := range s.schema.Selector(metric, site).Matchers {
+		filters = append(filters, fluxMatcher(m))
+	}
+	return fmt.Sprintf("from(bucket: %s)\n  |> range(start: %s, stop: %s)\n  |> filter(fn: (r) => %s)\n  |> group(columns: [%s])",
+		fluxString(s.cfg.Bucket), fluxTime(start.Add(time.Nanosecond)), fluxTime(end.Add(time.Nanosecond)),
+		strings.Join(filters, " and "), fluxString(s.schema.SiteLabel))
+}
+
+func (s *InfluxSource) readings(ctx context.Context, query string) (Readings, error) {
+	rows, err := s.query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	readings := Readings{}
+	for _, row := range rows {
+		readings[row.site] = row.value
+	}
+	return readings, nil
+}
+
+type fluxRow struct {
+	site  string
+	time  time.Time
+	value float64
+}
+
+// influxErrorResponse is the body of an InfluxDB API error.
+type influxErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// query runs one Flux query and reads the site, time and value of each
+// row of the result. Every query is logged against the caller's request
+// as Prometheus queries are.
+func (s *InfluxSource) query(ctx context.Context, query string) (rows []fluxRow, err error) {
+	if err := upstreamBreaker.Allow(); err != nil {
+		return nil, err
+	}
+	defer func() { upstreamBreaker.Record(err) }()
+
+	endpoint := s.cfg.URL + "/api/v2/query"
+	ctx, span := tracer.Start(ctx, "influxdb query",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "influxdb"),
+			attribute.String("db.statement", query),
+			attribute.String("server.address", endpoint),
+		),
+	)
+	defer func() { endSpan(span, err) }()
+
+	logger := LoggerFrom(ctx).With("query", query, "endpoint", endpoint)
+	start := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint+"?"+url.Values{"org": {s.cfg.Org}}.Encode(), strings.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.flux")
+	req.Header.Set("Accept", "application/csv")
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.cfg.Token)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		logger.Error("influxdb query failed", "duration", time.Since(start), "err", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		var influxErr influxErrorResponse
+		if json.Unmarshal(body, &influxErr) != nil {
+			influxErr = influxErrorResponse{Code: "http", Message: resp.Status}
+		}
+		err = &QueryError{System: "influxdb", ErrorType: influxErr.Code, Message: influxErr.Message, StatusCode: resp.StatusCode}
+		logger.Error("influxdb query failed", "duration", time.Since(start), "http_status", resp.StatusCode, "err", err)
+		return nil, err
+	}
+
+	rows, err = readFluxCSV(resp.Body, s.schema.SiteLabel)
+	if err != nil {
+		logger.Error("influxdb query failed", "duration", time.Since(start), "http_status", resp.StatusCode, "err", err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("influxdb.rows", len(rows)))
+	logger.Debug("influxdb query", "duration", time.Since(start), "http_status", resp.StatusCode, "rows", len(rows))
+	return rows, nil
+}
+
+// readFluxCSV reads a query result in InfluxDB's CSV format, where each
+// table starts with its own header row, taking each row's site from the
+// siteTag column. A query that fails after the response has started ends
+// with an error table instead.
+func readFluxCSV(r io.Reader, siteTag string) (rows []fluxRow, err error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	var columns map[string]int
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(record, "_value") || slices.Contains(record, "error") {
+			columns = map[string]int{}
+			for i, name := range record {
+				columns[name] = i
+			}
+			continue
+		}
+		if columns == nil {
+			return nil, errors.New("influxdb result has no header")
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		if message := field("error"); message != "" {
+			return nil, &QueryError{System: "influxdb", ErrorType: "query", Message: message, StatusCode: http.StatusOK}
+		}
+		value, err := strconv.ParseFloat(field("_value"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("influxdb value: %w", err)
+		}
+		row := fluxRow{site: field(siteTag), value: value}
+		if t := field("_time"); t != "" {
+			if row.time, err = time.Parse(time.RFC3339Nano, t); err != nil {
+				return nil, fmt.Errorf("influxdb time: %w", err)
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// fluxMatcher writes m as a Flux predicate on r. Regular expressions are
+// anchored, as they are in PromQL.
+func fluxMatcher(m Matcher) string {
+	tag := "r[" + fluxString(m.Label) + "]"
+	switch m.Op {
+	case "=":
+		return tag + " == " + fluxString(m.Value)
+	case "!=":
+		return tag + " != " + fluxString(m.Value)
+	}
+	re := "/^(?:" + fluxRegexBody(m.Value) + ")$/"
+	if m.Op == "=~" {
+		return tag + " =~ " + re
+	}
+	return tag + " !~ " + re
+}
+
+// fluxRegexBody escapes the slashes in re that would end a Flux regular
+// expression literal, leaving those already escaped alone.
+func fluxRegexBody(re string) string {
+	var b strings.Builder
+	for i := 0; i < len(re); i++ {
+		switch re[i] {
+		case '\\':
+			b.WriteByte(re[i])
+			if i+1 < len(re) {
+				i++
+				b.WriteByte(re[i])
+			}
+		case '/':
+			b.WriteString(`\/`)
+		default:
+			b.WriteByte(re[i])
+		}
+	}
+	return b.String()
+}
+
+// fluxString quotes s as a Flux string literal.
+func fluxString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`).Replace(s) + `"`
+}
+
+func fluxTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// fluxDuration writes d in whole seconds.
+func fluxDuration(d time.Duration) string {
+	return strconv.FormatInt(max(int64(d/time.Second), 1), 10) + "s"
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestFluxString(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Airport", `"Airport"`},
+		{"St Mary's", `"St Mary's"`},
+		{"Porthcressa Café", `"Porthcressa Café"`},
+		{`C:\meters`, `"C:\\meters"`},
+		{`the "old" school`, `"the \"old\" school"`},
+		// Flux would interpolate ${...}
+		{"${site}", `"\${site}"`},
+		{"$5 and {braces}", `"$5 and {braces}"`},
+		{"a,b", `"a,b"`},
+		{`\${`, `"\\\${"`},
+	}
+	for _, tt := range tests {
+		if got := fluxString(tt.in); got != tt.want {
+			t.Errorf("fluxString(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFluxMatcher(t *testing.T) {
+	tests := []struct {
+		matcher string
+		want    string
+	}{
+		{`job="shelly"`, `r["job"] == "shelly"`},
+		{`site!="St Mary's"`, `r["site"] != "St Mary's"`},
+		{`site="Porthcressa Café"`, `r["site"] == "Porthcressa Café"`},
+		{`path="C:\\meters"`, `r["path"] == "C:\\meters"`},
+		{`name="the \"old\" school"`, `r["name"] == "the \"old\" school"`},
+		{`site="${site}"`, `r["site"] == "\${site}"`},
+		{`site="Airport, east"`, `r["site"] == "Airport, east"`},
+		{`instance=~"10\\..*"`, `r["instance"] =~ /^(?:10\..*)$/`},
+		{`topic!~"meters/.*"`, `r["topic"] !~ /^(?:meters\/.*)$/`},
+		// an escaped slash is already escaped, and an escaped backslash
+		// doesn't escape the slash after it
+		{`topic=~"a\\/b"`, `r["topic"] =~ /^(?:a\/b)$/`},
+		{`topic=~"a\\\\/b"`, `r["topic"] =~ /^(?:a\\\/b)$/`},
+		{`site=~"St Mary's|Café"`, `r["site"] =~ /^(?:St Mary's|Café)$/`},
+	}
+	for _, tt := range tests {
+		m, err := ParseMatcher(tt.matcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fluxMatcher(m); got != tt.want {
+			t.Errorf("fluxMatcher(%s) = %s, want %s", tt.matcher, got, tt.want)
+		}
+	}
+}
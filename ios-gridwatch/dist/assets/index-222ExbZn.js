@@ -3819,7 +3819,12 @@ class Float64RingBuffer {
     return { x: this.xBuffer[idx], y: this.yBuffer[idx] };
   }
 }
-const server = "https://home.harrylegg.co.uk/solar";
+const server = window.GRIDWATCH_CONFIG?.server ?? "https://home.harrylegg.co.uk/solar";
+function pollInterval(generating) {
+  var _a, _b;
+  const poll = (_a = window.GRIDWATCH_CONFIG) == null ? void 0 : _a.poll;
+  return (_b = generating ? poll == null ? void 0 : poll.day_ms : poll == null ? void 0 : poll.night_ms) != null ? _b : 6e4;
+}
 let liveData = {};
 const sitePeriodData = {};
 const periods = [1, 7, 31, 365];
@@ -3864,15 +3869,15 @@ const updateTimer = {
     this.element.style.left = `calc(50% - ${width / 2}px)`;
     this.element.style.top = `calc(50% - ${height / 2}px)`;
   },
-  start: function() {
+  start: function(generating) {
     if (this.interval === null) {
-      this.newEta();
+      this.newEta(generating);
       this.interval = setInterval(() => updateTimer.update(), 100);
     }
     return this.interval;
   },
-  newEta: function() {
-    this.eta = Date.now() + 6e4;
+  newEta: function(generating) {
+    this.eta = Date.now() + pollInterval(generating);
   }
 };
 const sortingOptions = document.querySelectorAll("[name=sort]");
@@ -4163,19 +4168,21 @@ document.addEventListener("DOMContentLoaded", () => {
       });
     }
     if (sites_carousel.firstElementChild) {
-      updateTimer.newEta();
+      updateTimer.newEta(liveData["current_w"] > 0);
       liveData.sites.forEach((site, i) => {
         const spacelessName = site.name.replaceAll(" ", "").replaceAll("(", "").replaceAll(")", "");
         sites_carousel.querySelectorAll(`.${spacelessName}-snapshot`).forEach((span) => {
           span.textContent = formatWatts(site.snapshot);
         });
       });
-      combinedSolarData.push({
-        x: referenceDay(),
-        y: liveData["current_w"] / 1e6
-      });
+      if (!liveData.stale) {
+        combinedSolarData.push({
+          x: referenceDay(liveData["time"]),
+          y: liveData["current_w"] / 1e6
+        });
+      }
     } else {
-      updateTimer.start();
+      updateTimer.start(liveData["current_w"] > 0);
       if (((_a = liveData["sites"]) == null ? void 0 : _a.length) > 0) {
         const virtualSite = liveData.sites.pop();
         const sortedSites = liveData["sites"].sort((a, b) => b.snapshot - a.snapshot);
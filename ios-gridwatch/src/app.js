@@ -9,7 +9,7 @@ import { twoSTDsBelow } from "./twoSTDsBelow"
 import { roundUpToQuarterSignificant } from "./mathematicalFunctions"
 import { initDropdown } from "./dropdown"
 import { Float64RingBuffer } from "./ringBuffer"
-import { server } from "./config.js"
+import { server, pollInterval } from "./config.js"
 
 let liveData={}
 const sitePeriodData={}
@@ -56,15 +56,15 @@ const updateTimer={
         this.element.style.left = `calc(50% - ${width / 2}px)`
         this.element.style.top = `calc(50% - ${height / 2}px)`
     },
-    start:function(){
+    start:function(generating){
         if(this.interval===null){
-            this.newEta()
+            this.newEta(generating)
             this.interval=setInterval(()=>updateTimer.update(),100)
         }
         return this.interval
     },
-    newEta:function(){
-        this.eta=Date.now()+60000
+    newEta:function(generating){
+        this.eta=Date.now()+pollInterval(generating)
     }
 }
 const sortingOptions=document.querySelectorAll("[name=sort]")
@@ -375,20 +375,22 @@ document.addEventListener("DOMContentLoaded",()=>{
             })
         }
         if(sites_carousel.firstElementChild){//if not first message
-            updateTimer.newEta()
+            updateTimer.newEta(liveData["current_w"]>0)
             liveData.sites.forEach((site,i) => {
                 const spacelessName=site.name.replaceAll(" ","").replaceAll("(","").replaceAll(")","")
                 sites_carousel.querySelectorAll(`.${spacelessName}-snapshot`).forEach(span=>{
                     span.textContent=formatWatts(site.snapshot)
                 })
             });
-            combinedSolarData.push({
-                x:referenceDay(),
-                y:liveData["current_w"]/1000000,
-            })
+            if(!liveData.stale){//re-sent while live data is unavailable
+                combinedSolarData.push({
+                    x:referenceDay(liveData["time"]),
+                    y:liveData["current_w"]/1000000,
+                })
+            }
         }
         else{ //if first message
-            updateTimer.start()
+            updateTimer.start(liveData["current_w"]>0)
             if(liveData['sites']?.length>0){
                 const virtualSite=liveData.sites.pop()
                 const sortedSites=liveData['sites'].sort((a,b)=>b.snapshot-a.snapshot)
@@ -1 +1,9 @@
-export const server="https://home.harrylegg.co.uk/solar";
+// gridwatch serves /config.js with the API base for the deployment it is
+// running in; fall back to the public server when the page is hosted elsewhere.
+export const server=window.GRIDWATCH_CONFIG?.server ?? "https://home.harrylegg.co.uk/solar";
+// the server polls more often while the sun is up; count down to its next
+// poll, taking anything generating as daytime
+export function pollInterval(generating){
+    const poll=window.GRIDWATCH_CONFIG?.poll
+    return (generating ? poll?.day_ms : poll?.night_ms) ?? 60000
+}
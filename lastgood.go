@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// lastGoodEntries bounds each LastGood store, as keys include
+// client-chosen periods.
+const lastGoodEntries = 256
+
+// LastGood keeps the latest successful result for each query, to answer
+// with while the data source is down.
+type LastGood[T any] struct {
+	mu      sync.Mutex
+	entries map[string]lastGoodEntry[T]
+}
+
+type lastGoodEntry[T any] struct {
+	value T
+	at    time.Time
+}
+
+func NewLastGood[T any]() *LastGood[T] {
+	return &LastGood[T]{entries: map[string]lastGoodEntry[T]{}}
+}
+
+func (s *LastGood[T]) Put(key string, value T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[key]; !ok && len(s.entries) >= lastGoodEntries {
+		oldest := ""
+		for k, entry := range s.entries {
+			if oldest == "" || entry.at.Before(s.entries[oldest].at) {
+				oldest = k
+			}
+		}
+		delete(s.entries, oldest)
+	}
+	s.entries[key] = lastGoodEntry[T]{value: value, at: time.Now()}
+}
+
+// Fallback returns the last good result for key and its age, if err says
+// the data source is down and there is one.
+func (s *LastGood[T]) Fallback(key string, err error) (value T, age time.Duration, ok bool) {
+	if !upstreamDown(err) {
+		return value, 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return value, 0, false
+	}
+	return entry.value, time.Since(entry.at), true
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+// streamRetryAfter is how long a client turned away for too many streams is
+// asked to wait before trying again.
+const streamRetryAfter = 30 * time.Second
+
+// IPExtractor returns how c.RealIP() finds the client address. Forwarded
+// headers are only believed when the connection comes from a trusted proxy;
+// with no proxies configured the peer address is used as-is.
+func IPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range trustedProxies {
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an IP or CIDR", proxy)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			ipRange = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// RateLimitMiddleware limits each client IP to cfg.Rate requests a second
+// with bursts of up to cfg.Burst. A zero rate disables the limit.
+func RateLimitMiddleware(cfg RateLimitConfig) echo.MiddlewareFunc {
+	if cfg.Rate <= 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	}
+
+	retryAfter := strconv.Itoa(int(math.Ceil(1 / cfg.Rate)))
+	store := middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+		Rate:      rate.Limit(cfg.Rate),
+		Burst:     cfg.Burst,
+		ExpiresIn: 10 * time.Minute,
+	})
+
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store: store,
+		IdentifierExtractor: func(c echo.Context) (string, error) {
+			return c.RealIP(), nil
+		},
+		DenyHandler: func(c echo.Context, identifier string, err error) error {
+			LoggerFrom(c.Request().Context()).Warn("rate limited", "ip", identifier)
+			c.Response().Header().Set("Retry-After", retryAfter)
+			return c.JSON(http.StatusTooManyRequests, map[string]string{"message": "too many requests"})
+		},
+	})
+}
+
+var (
+	errTooManyStreams      = errors.New("too many streams")
+	errTooManyStreamsForIP = errors.New("too many streams from this address")
+)
+
+// StreamLimiter caps the number of concurrent long-lived streams, both in
+// total and per client IP. A zero limit means unlimited.
+type StreamLimiter struct {
+	max      int
+	maxPerIP int
+
+	mu    sync.Mutex
+	total int
+	byIP  map[string]int
+}
+
+func NewStreamLimiter(max int, maxPerIP int) *StreamLimiter {
+	return &StreamLimiter{max: max, maxPerIP: maxPerIP, byIP: map[string]int{}}
+}
+
+// Acquire reserves a stream for ip. The returned function must be called
+// once the stream ends.
+func (l *StreamLimiter) Acquire(ip string) (release func(), err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.total >= l.max {
+		return nil, errTooManyStreams
+	}
+	if l.maxPerIP > 0 && l.byIP[ip] >= l.maxPerIP {
+		return nil, errTooManyStreamsForIP
+	}
+	l.total++
+	l.byIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if l.byIP[ip]--; l.byIP[ip] <= 0 {
+				delete(l.byIP, ip)
+			}
+		})
+	}, nil
+}
+
+// Middleware holds a stream slot for the lifetime of the request, turning
+// the client away with 429 when none is free.
+func (l *StreamLimiter) Middleware() echo.MiddlewareFunc {
+	retryAfter := strconv.Itoa(int(streamRetryAfter.Seconds()))
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			release, err := l.Acquire(c.RealIP())
+			if err != nil {
+				LoggerFrom(c.Request().Context()).Warn("stream refused", "ip", c.RealIP(), "reason", err)
+				c.Response().Header().Set("Retry-After", retryAfter)
+				return c.JSON(http.StatusTooManyRequests, map[string]string{"message": err.Error()})
+			}
+			defer release()
+			return next(c)
+		}
+	}
+}
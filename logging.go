@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewLogger builds the process logger. format is "text" or "json" and level
+// one of debug, info, warn or error.
+func NewLogger(level string, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("bad log level %q", level)
+	}
+	options := &slog.HandlerOptions{Level: lvl}
+
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, options)), nil
+	default:
+		return nil, fmt.Errorf("bad log format %q", format)
+	}
+}
+
+// fatal logs a startup error and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFrom returns the logger for the request ctx belongs to, or the
+// default logger outside of a request.
+func LoggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// RequestLogging gives every request an ID, echoed in X-Request-ID, and a
+// logger tagged with it that follows the request context down to each
+// upstream query. Completed requests are logged once with their outcome.
+func RequestLogging() []echo.MiddlewareFunc {
+	requestID := middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		RequestIDHandler: func(c echo.Context, id string) {
+			logger := slog.Default().With("request_id", id)
+			if span := trace.SpanContextFromContext(c.Request().Context()); span.IsValid() {
+				logger = logger.With("trace_id", span.TraceID().String())
+			}
+			c.SetRequest(c.Request().WithContext(WithLogger(c.Request().Context(), logger)))
+		},
+	})
+
+	access := middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		LogMethod:   true,
+		LogURI:      true,
+		LogStatus:   true,
+		LogLatency:  true,
+		LogRemoteIP: true,
+		LogError:    true,
+		HandleError: true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			attrs := []any{
+				"method", v.Method,
+				"uri", v.URI,
+				"status", v.Status,
+				"duration", v.Latency.Round(time.Millisecond),
+				"ip", v.RemoteIP,
+			}
+			logger := LoggerFrom(c.Request().Context())
+			if v.Error != nil {
+				logger.Error("request failed", append(attrs, "err", v.Error)...)
+			} else {
+				logger.Info("request", attrs...)
+			}
+			return nil
+		},
+	})
+
+	return []echo.MiddlewareFunc{requestID, access}
+}
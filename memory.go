@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Measurement says which of a site's meters a reading comes from.
+type Measurement int
+
+const (
+	MeasureMeter Measurement = iota // energy meter reading in kWh
+	MeasurePower                    // power in watts
+)
+
+// MemorySource answers queries from readings held in memory, for backends
+// that load or collect the readings themselves. Once readings have been
+// forgotten, energy and peak power over windows reaching back past them
+// have no answer, rather than one covering only what is held.
+type MemorySource struct {
+	mu        sync.RWMutex
+	sites     map[string]*memorySite
+	forgotten time.Time // readings before it have been dropped
+}
+
+type memorySite struct {
+	meter []Point // sorted by time
+	power []Point
+}
+
+func NewMemorySource() *MemorySource {
+	return &MemorySource{sites: map[string]*memorySite{}}
+}
+
+// Add records a reading, replacing any taken at the same time. Readings
+// may arrive in any order.
+func (m *MemorySource) Add(site string, measure Measurement, p Point) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.sites[site]
+	if s == nil {
+		s = &memorySite{}
+		m.sites[site] = s
+	}
+	points := &s.meter
+	if measure == MeasurePower {
+		points = &s.power
+	}
+	i, found := slices.BinarySearchFunc(*points, p.Time, func(p Point, t time.Time) int { return p.Time.Compare(t) })
+	if found {
+		(*points)[i] = p
+		return
+	}
+	*points = slices.Insert(*points, i, p)
+}
+
+// Forget drops the readings taken before t, and any site left with none.
+func (m *MemorySource) Forget(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t.After(m.forgotten) {
+		m.forgotten = t
+	}
+	for name, s := range m.sites {
+		for _, points := range []*[]Point{&s.meter, &s.power} {
+			i, _ := slices.BinarySearchFunc(*points, t, func(p Point, t time.Time) int { return p.Time.Compare(t) })
+			*points = slices.Delete(*points, 0, i)
+		}
+		if len(s.meter) == 0 && len(s.power) == 0 {
+			delete(m.sites, name)
+		}
+	}
+}
+
+// DiscoverSites lists the sites with readings. Their labels aren't kept,
+// so readings without a site are reported as one unknown series.
+func (m *MemorySource) DiscoverSites(ctx context.Context) (sites []string, unknown []map[string]string, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for name := range m.sites {
+		if name == "" {
+			unknown = append(unknown, map[string]string{})
+			continue
+		}
+		sites = append(sites, name)
+	}
+	slices.Sort(sites)
+	return sites, unknown, nil
+}
+
+func (m *MemorySource) MeterReadings(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return m.readings(site, MeasureMeter, start, end, func(points []Point) float64 { return points[len(points)-1].Value }), nil
+}
+
+func (m *MemorySource) CurrentPower(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return m.readings(site, MeasurePower, start, end, func(points []Point) float64 { return points[len(points)-1].Value }), nil
+}
+
+func (m *MemorySource) Energy(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	if !m.holds(start) {
+		return Readings{}, nil
+	}
+	return m.readings(site, MeasureMeter, start, end, func(points []Point) float64 { return points[len(points)-1].Value - points[0].Value }), nil
+}
+
+func (m *MemorySource) PeakPower(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	if !m.holds(start) {
+		return Readings{}, nil
+	}
+	return m.readings(site, MeasurePower, start, end, func(points []Point) float64 {
+		peak := points[0].Value
+		for _, p := range points[1:] {
+			peak = max(peak, p.Value)
+		}
+		return peak
+	}), nil
+}
+
+func (m *MemorySource) PowerSeries(ctx context.Context, site string, start, end time.Time, step time.Duration) (Series, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	series := Series{}
+	for name, s := range m.sites {
+		if site != "" && name != site {
+			continue
+		}
+		for t := start; !t.After(end); t = t.Add(step) {
+			points := window(s.power, t.Add(-step), t)
+			if len(points) == 0 {
+				continue
+			}
+			sum := 0.0
+			for _, p := range points {
+				sum += p.Value
+			}
+			series[name] = append(series[name], Point{Time: t, Value: sum / float64(len(points))})
+		}
+	}
+	return series, nil
+}
+
+// holds says whether every reading taken after start is still held.
+func (m *MemorySource) holds(start time.Time) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return !start.Before(m.forgotten)
+}
+
+// readings applies reduce to each site's readings of measure in the range,
+// leaving out sites with none.
+func (m *MemorySource) readings(site string, measure Measurement, start, end time.Time, reduce func([]Point) float64) Readings {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	readings := Readings{}
+	for name, s := range m.sites {
+		if site != "" && name != site {
+			continue
+		}
+		points := s.meter
+		if measure == MeasurePower {
+			points = s.power
+		}
+		if points = window(points, start, end); len(points) > 0 {
+			readings[name] = reduce(points)
+		}
+	}
+	return readings
+}
+
+// window is the points after start up to and including end.
+func window(points []Point, start, end time.Time) []Point {
+	from, _ := slices.BinarySearchFunc(points, start, func(p Point, t time.Time) int {
+		if p.Time.After(t) {
+			return 1
+		}
+		return -1
+	})
+	to, _ := slices.BinarySearchFunc(points, end, func(p Point, t time.Time) int {
+		if p.Time.After(t) {
+			return 1
+		}
+		return -1
+	})
+	return points[from:to]
+}
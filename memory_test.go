@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemorySourceForget(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	m := NewMemorySource()
+	for h := 72; h >= 0; h-- {
+		at := now.Add(-time.Duration(h) * time.Hour)
+		m.Add("Big Array", MeasureMeter, Point{Time: at, Value: float64(1000 + 72 - h)})
+		m.Add("Big Array", MeasurePower, Point{Time: at, Value: float64(h)})
+	}
+
+	// everything held answers for any window
+	if energy, _ := m.Energy(ctx, "", now.Add(-year), now); energy["Big Array"] != 72 {
+		t.Errorf("Energy over a year with everything held = %v, want 72", energy)
+	}
+
+	m.Forget(now.Add(-48 * time.Hour))
+	for _, tt := range []struct {
+		name   string
+		start  time.Time
+		energy float64
+		peak   float64
+		held   bool
+	}{
+		{"day", now.Add(-24 * time.Hour), 23, 23, true},
+		{"history", now.Add(-48 * time.Hour), 47, 47, true},
+		{"week", now.Add(-7 * 24 * time.Hour), 0, 0, false},
+		{"year", now.Add(-year), 0, 0, false},
+	} {
+		energy, _ := m.Energy(ctx, "", tt.start, now)
+		peak, _ := m.PeakPower(ctx, "Big Array", tt.start, now)
+		if !tt.held {
+			if len(energy) != 0 || len(peak) != 0 {
+				t.Errorf("%s: Energy = %v, PeakPower = %v over more than is held, want no answer", tt.name, energy, peak)
+			}
+			continue
+		}
+		if energy["Big Array"] != tt.energy || peak["Big Array"] != tt.peak {
+			t.Errorf("%s: Energy = %v, PeakPower = %v, want %v and %v", tt.name, energy, peak, tt.energy, tt.peak)
+		}
+	}
+
+	// the meter reading is the latest however far back the window goes
+	if meter, _ := m.MeterReadings(ctx, "", now.Add(-year), now); meter["Big Array"] != 1072 {
+		t.Errorf("MeterReadings = %v, want 1072", meter)
+	}
+	// forgetting less than before doesn't bring the windows back
+	m.Forget(now.Add(-year))
+	if energy, _ := m.Energy(ctx, "", now.Add(-7*24*time.Hour), now); len(energy) != 0 {
+		t.Errorf("Energy over a week after forgetting less = %v, want no answer", energy)
+	}
+}
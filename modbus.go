@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Modbus TCP, as much of it as reading registers takes: a client for
+// function 3, read holding registers, and a server that answers it from a
+// register map.
+
+const (
+	modbusReadHolding = 3
+	modbusReadInput   = 4
+
+	// modbusMaxRegisters is the most one read may ask for.
+	modbusMaxRegisters = 125
+)
+
+// ModbusError is an exception response.
+type ModbusError struct {
+	Function byte
+	Code     byte
+}
+
+func (e *ModbusError) Error() string {
+	switch e.Code {
+	case 1:
+		return fmt.Sprintf("modbus function %d: illegal function", e.Function)
+	case 2:
+		return fmt.Sprintf("modbus function %d: illegal data address", e.Function)
+	case 3:
+		return fmt.Sprintf("modbus function %d: illegal data value", e.Function)
+	}
+	return fmt.Sprintf("modbus function %d: exception %d", e.Function, e.Code)
+}
+
+// ModbusClient reads holding registers from one unit over Modbus TCP. It
+// connects on first use and again after any error. It is not safe for
+// concurrent use.
+type ModbusClient struct {
+	addr    string
+	unit    byte
+	timeout time.Duration
+
+	conn net.Conn
+	tid  uint16
+}
+
+// NewModbusClient talks to unit at addr, host:port, waiting at most
+// timeout for each answer.
+func NewModbusClient(addr string, unit byte, timeout time.Duration) *ModbusClient {
+	return &ModbusClient{addr: addr, unit: unit, timeout: timeout}
+}
+
+// ReadHoldingRegisters reads count registers from address on.
+func (c *ModbusClient) ReadHoldingRegisters(ctx context.Context, address uint16, count uint16) (registers []uint16, err error) {
+	if count == 0 || count > modbusMaxRegisters {
+		return nil, fmt.Errorf("modbus: can't read %d registers at once", count)
+	}
+	defer func() {
+		// the stream can't be trusted after a failure part way through
+		var modbusErr *ModbusError
+		if err != nil && !errors.As(err, &modbusErr) {
+			c.Close()
+		}
+	}()
+	if c.conn == nil {
+		var dialer net.Dialer
+		if c.conn, err = dialer.DialContext(ctx, "tcp", c.addr); err != nil {
+			return nil, err
+		}
+	}
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+
+	c.tid++
+	req := make([]byte, 12)
+	binary.BigEndian.PutUint16(req[0:], c.tid)
+	binary.BigEndian.PutUint16(req[2:], 0) // protocol
+	binary.BigEndian.PutUint16(req[4:], 6) // unit, function and data
+	req[6] = c.unit
+	req[7] = modbusReadHolding
+	binary.BigEndian.PutUint16(req[8:], address)
+	binary.BigEndian.PutUint16(req[10:], count)
+	if _, err := c.conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	tid, unit, pdu, err := readModbusFrame(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	if tid != c.tid || unit != c.unit {
+		return nil, fmt.Errorf("modbus: answer to transaction %d from unit %d, want %d from %d", tid, unit, c.tid, c.unit)
+	}
+	if pdu[0] == modbusReadHolding|0x80 && len(pdu) == 2 {
+		return nil, &ModbusError{Function: modbusReadHolding, Code: pdu[1]}
+	}
+	if pdu[0] != modbusReadHolding || len(pdu) < 2 || int(pdu[1]) != 2*int(count) || len(pdu) != 2+2*int(count) {
+		return nil, errors.New("modbus: malformed answer")
+	}
+	registers = make([]uint16, count)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(pdu[2+2*i:])
+	}
+	return registers, nil
+}
+
+// Close drops the connection, if there is one.
+func (c *ModbusClient) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// readModbusFrame reads one Modbus TCP frame, returning its transaction,
+// unit and PDU.
+func readModbusFrame(r io.Reader) (tid uint16, unit byte, pdu []byte, err error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > 254 {
+		return 0, 0, nil, errors.New("modbus: bad frame header")
+	}
+	pdu = make([]byte, length-1)
+	if _, err := io.ReadFull(r, pdu); err != nil {
+		return 0, 0, nil, err
+	}
+	return binary.BigEndian.Uint16(header[0:]), header[6], pdu, nil
+}
+
+// ModbusServer answers reads of holding and input registers, which are
+// the same, from a register map any unit may read.
+type ModbusServer struct {
+	mu        sync.RWMutex
+	registers [1 << 16]uint16
+}
+
+func NewModbusServer() *ModbusServer {
+	return &ModbusServer{}
+}
+
+// SetRegisters writes values from address on.
+func (s *ModbusServer) SetRegisters(address uint16, values []uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(s.registers[address:], values)
+}
+
+// Serve answers connections on l until it is closed.
+func (s *ModbusServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *ModbusServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		tid, unit, pdu, err := readModbusFrame(conn)
+		if err != nil {
+			return
+		}
+		answer := s.answer(pdu)
+		frame := make([]byte, 7, 7+len(answer))
+		binary.BigEndian.PutUint16(frame[0:], tid)
+		binary.BigEndian.PutUint16(frame[4:], uint16(len(answer)+1))
+		frame[6] = unit
+		if _, err := conn.Write(append(frame, answer...)); err != nil {
+			return
+		}
+	}
+}
+
+// answer works out the response PDU to a request PDU.
+func (s *ModbusServer) answer(pdu []byte) []byte {
+	function := pdu[0]
+	if function != modbusReadHolding && function != modbusReadInput {
+		return []byte{function | 0x80, 1}
+	}
+	if len(pdu) != 5 {
+		return []byte{function | 0x80, 3}
+	}
+	address := int(binary.BigEndian.Uint16(pdu[1:]))
+	count := int(binary.BigEndian.Uint16(pdu[3:]))
+	if count == 0 || count > modbusMaxRegisters {
+		return []byte{function | 0x80, 3}
+	}
+	if address+count > len(s.registers) {
+		return []byte{function | 0x80, 2}
+	}
+	answer := make([]byte, 2+2*count)
+	answer[0], answer[1] = function, byte(2*count)
+	s.mu.RLock()
+	for i := range count {
+		binary.BigEndian.PutUint16(answer[2+2*i:], s.registers[address+i])
+	}
+	s.mu.RUnlock()
+	return answer
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttTimeout bounds each subscribe and publish.
+const mqttTimeout = 5 * time.Second
+
+// mqttOptions sets up a client of cfg.Broker that connects in the
+// background, and keeps reconnecting, once Connect is called.
+func mqttOptions(cfg MQTTConfig, clientID string) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(clientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetOrderMatters(false)
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		slog.Warn("lost MQTT broker", "broker", cfg.Broker, "client_id", clientID, "err", err)
+	})
+	return opts
+}
+
+// mqttWait waits for token, giving up after mqttTimeout.
+func mqttWait(token mqtt.Token) error {
+	if !token.WaitTimeout(mqttTimeout) {
+		return errors.New("timed out")
+	}
+	return token.Error()
+}
+
+// MQTTSource takes the readings devices publish over MQTT. Power and
+// energy each come from a topic filter whose first + level names the
+// site, as in meters/+/power. A payload is either a bare number or JSON
+// holding it in the configured field, which may be a dotted path such as
+// aenergy.total. Like ShellySource it keeps only the last cfg.History of
+// readings.
+type MQTTSource struct {
+	*MemorySource
+
+	cfg    MQTTConfig
+	topics []mqttTopic
+
+	warned sync.Map // topics whose bad payloads have been logged
+}
+
+type mqttTopic struct {
+	measure Measurement
+	filter  string
+	site    int // the level naming the site
+	field   string
+	scale   float64
+}
+
+func NewMQTTSource(cfg MQTTConfig) (*MQTTSource, error) {
+	if cfg.Broker == "" {
+		return nil, fmt.Errorf("reading from MQTT needs a broker")
+	}
+	s := &MQTTSource{MemorySource: NewMemorySource(), cfg: cfg}
+	scale := 1.0
+	switch cfg.EnergyUnit {
+	case "kWh":
+	case "Wh":
+		scale = 0.001
+	default:
+		return nil, fmt.Errorf("bad MQTT energy unit %q, want kWh or Wh", cfg.EnergyUnit)
+	}
+	for _, t := range []mqttTopic{
+		{measure: MeasurePower, filter: cfg.PowerTopic, field: cfg.PowerField, scale: 1},
+		{measure: MeasureMeter, filter: cfg.EnergyTopic, field: cfg.EnergyField, scale: scale},
+	} {
+		if t.filter == "" {
+			continue
+		}
+		t.site = -1
+		for i, level := range strings.Split(t.filter, "/") {
+			if level == "+" {
+				t.site = i
+				break
+			}
+		}
+		if t.site < 0 {
+			return nil, fmt.Errorf("MQTT topic %q has no + level to name the site", t.filter)
+		}
+		s.topics = append(s.topics, t)
+	}
+	if len(s.topics) == 0 {
+		return nil, fmt.Errorf("reading from MQTT needs a power or energy topic")
+	}
+	return s, nil
+}
+
+// Run subscribes to the topics, again on every reconnect, until ctx is
+// done.
+func (s *MQTTSource) Run(ctx context.Context) {
+	clientID := s.cfg.ClientID + "-ingest"
+	opts := mqttOptions(s.cfg, clientID)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		slog.Info("connected to MQTT broker", "broker", s.cfg.Broker, "client_id", clientID)
+		for _, t := range s.topics {
+			if err := mqttWait(c.Subscribe(t.filter, 0, s.handler(t))); err != nil {
+				slog.Error("subscribing to MQTT topic failed", "topic", t.filter, "err", err)
+			}
+		}
+	})
+	client := mqtt.NewClient(opts)
+	client.Connect()
+
+	if s.cfg.History > 0 {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		// forgetting from the start, so that windows longer than the
+		// history go unanswered before the first readings are dropped
+		for now, done := time.Now(), false; !done; {
+			s.Forget(now.Add(-s.cfg.History))
+			select {
+			case <-ctx.Done():
+				done = true
+			case now = <-ticker.C:
+			}
+		}
+	} else {
+		<-ctx.Done()
+	}
+	client.Disconnect(250)
+}
+
+// handler records the readings published on t, stamped with when they
+// arrive.
+func (s *MQTTSource) handler(t mqttTopic) mqtt.MessageHandler {
+	return func(c mqtt.Client, msg mqtt.Message) {
+		levels := strings.Split(msg.Topic(), "/")
+		if t.site >= len(levels) || levels[t.site] == "" {
+			return
+		}
+		value, err := mqttValue(msg.Payload(), t.field)
+		if err != nil {
+			if _, warned := s.warned.LoadOrStore(msg.Topic(), true); !warned {
+				slog.Warn("bad MQTT reading", "topic", msg.Topic(), "err", err)
+			}
+			return
+		}
+		s.Add(levels[t.site], t.measure, Point{Time: time.Now(), Value: value * t.scale})
+	}
+}
+
+// mqttValue reads a payload that is either a number or JSON holding one
+// at field.
+func mqttValue(payload []byte, field string) (float64, error) {
+	text := strings.TrimSpace(string(payload))
+	if value, err := strconv.ParseFloat(text, 64); err == nil {
+		return value, nil
+	}
+	var v any
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		return 0, errors.New("payload is neither a number nor JSON")
+	}
+	for _, key := range strings.Split(field, ".") {
+		object, ok := v.(map[string]any)
+		if !ok {
+			return 0, fmt.Errorf("payload has no %s", field)
+		}
+		if v, ok = object[key]; !ok {
+			return 0, fmt.Errorf("payload has no %s", field)
+		}
+	}
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("%s is not a number", field)
+}
+
+// MQTTPublisher publishes each live update under cfg.Publish: the totals
+// to <prefix>/state and each site to <prefix>/site/<site>/state, both
+// retained, with <prefix>/status saying whether gridwatch is online. It
+// also announces a sensor for each to Home Assistant's MQTT discovery
+// under cfg.Discovery, unless that is empty.
+type MQTTPublisher struct {
+	cfg MQTTConfig
+	hub *Hub
+
+	client     mqtt.Client
+	connected  chan struct{}   // signalled on every connect
+	node       string          // identifies gridwatch to Home Assistant
+	announced  map[string]bool // by site, "" for the totals
+	reannounce atomic.Bool     // set when the announcements may be gone
+}
+
+func NewMQTTPublisher(cfg MQTTConfig, hub *Hub) (*MQTTPublisher, error) {
+	if cfg.Broker == "" {
+		return nil, fmt.Errorf("publishing to MQTT needs a broker")
+	}
+	if strings.ContainsAny(cfg.Publish, "+#") {
+		return nil, fmt.Errorf("bad MQTT publish prefix %q", cfg.Publish)
+	}
+	return &MQTTPublisher{
+		cfg:       cfg,
+		hub:       hub,
+		connected: make(chan struct{}, 1),
+		node:      mqttSlug(cfg.ClientID),
+		announced: map[string]bool{},
+	}, nil
+}
+
+// Run publishes the hub's updates until ctx is done.
+func (p *MQTTPublisher) Run(ctx context.Context) {
+	clientID := p.cfg.ClientID + "-publish"
+	status := p.cfg.Publish + "/status"
+	opts := mqttOptions(p.cfg, clientID)
+	opts.SetWill(status, "offline", 1, true)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		slog.Info("connected to MQTT broker", "broker", p.cfg.Broker, "client_id", clientID)
+		c.Publish(status, 1, true, "online")
+		p.reannounce.Store(true)
+		if p.cfg.Discovery != "" {
+			// Home Assistant forgets what was announced when it restarts
+			c.Subscribe(p.cfg.Discovery+"/status", 0, func(c mqtt.Client, msg mqtt.Message) {
+				if string(msg.Payload()) == "online" {
+					p.reannounce.Store(true)
+				}
+			})
+		}
+		select {
+		case p.connected <- struct{}{}:
+		default:
+		}
+	})
+	p.client = mqtt.NewClient(opts)
+	p.client.Connect()
+	defer func() {
+		mqttWait(p.client.Publish(status, 1, true, "offline"))
+		p.client.Disconnect(250)
+	}()
+
+	// the latest state, published again whenever the broker is
+	// reconnected to since updates only come when something changes
+	var latest *SolarData
+	for ctx.Err() == nil {
+		updates, backlog, _ := p.hub.Subscribe("")
+		if len(backlog) > 0 {
+			latest = &backlog[len(backlog)-1].State
+			p.publish(*latest)
+		}
+		for open := true; open; {
+			select {
+			case <-ctx.Done():
+				p.hub.Unsubscribe(updates)
+				return
+			case <-p.connected:
+				if latest != nil {
+					p.publish(*latest)
+				}
+			case ev, ok := <-updates:
+				// the hub drops subscribers that fall behind; subscribe
+				// again rather than stop
+				if open = ok; ok {
+					latest = &ev.State
+					p.publish(*latest)
+				}
+			}
+		}
+	}
+}
+
+// mqttTotals is what is published of the totals.
+type mqttTotals struct {
+	Time      int64   `json:"time"`
+	Total_kwh float32 `json:"total_kwh"`
+	Day_kwh   float32 `json:"day_kwh"`
+	Week_kwh  float32 `json:"week_kwh"`
+	Year_kwh  float32 `json:"year_kwh"`
+	Current_w float32 `json:"current_w"`
+	Stale     bool    `json:"stale,omitempty"`
+}
+
+func (p *MQTTPublisher) publish(state SolarData) {
+	if !p.client.IsConnectionOpen() {
+		return
+	}
+	if p.reannounce.Swap(false) {
+		clear(p.announced)
+	}
+	p.announceTotals()
+	p.send(p.cfg.Publish+"/state", mqttTotals{
+		Time:      state.Time,
+		Total_kwh: state.Total_kwh,
+		Day_kwh:   state.Day_kwh,
+		Week_kwh:  state.Week_kwh,
+		Year_kwh:  state.Year_kwh,
+		Current_w: state.Current_w,
+		Stale:     state.Stale,
+	})
+	for _, site := range state.Sites {
+		p.announceSite(site.Name)
+		p.send(p.siteTopic(site.Name), site)
+	}
+}
+
+func (p *MQTTPublisher) siteTopic(site string) string {
+	return p.cfg.Publish + "/site/" + mqttSlug(site) + "/state"
+}
+
+// send publishes v as JSON, retained.
+func (p *MQTTPublisher) send(topic string, v any) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("encoding MQTT message failed", "topic", topic, "err", err)
+		return
+	}
+	if err := mqttWait(p.client.Publish(topic, 0, true, payload)); err != nil {
+		slog.Warn("publishing to MQTT failed", "topic", topic, "err", err)
+	}
+}
+
+// haSensor is a Home Assistant MQTT discovery message for a sensor.
+type haSensor struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	Unit              string   `json:"unit_of_measurement"`
+	DeviceClass       string   `json:"device_class"`
+	StateClass        string   `json:"state_class"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	Device            haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+	Model       string   `json:"model,omitempty"`
+	ViaDevice   string   `json:"via_device,omitempty"`
+}
+
+// haReading is one value of a state message, as a sensor.
+type haReading struct {
+	key   string // the JSON field
+	name  string
+	unit  string
+	class string // power or energy
+	state string // measurement or total_increasing
+}
+
+var (
+	haTotals = []haReading{
+		{"current_w", "Solar power", "W", "power", "measurement"},
+		{"day_kwh", "Solar energy today", "kWh", "energy", "total_increasing"},
+		{"total_kwh", "Solar energy", "kWh", "energy", "total_increasing"},
+	}
+	haSite = []haReading{
+		{"snapshot", "Power", "W", "power", "measurement"},
+		{"today", "Energy today", "kWh", "energy", "total_increasing"},
+	}
+)
+
+func (p *MQTTPublisher) announceTotals() {
+	if p.cfg.Discovery == "" || p.announced[""] {
+		return
+	}
+	device := haDevice{Identifiers: []string{p.node}, Name: "Island solar", Model: "gridwatch"}
+	for _, r := range haTotals {
+		p.announce(p.node+"_"+r.key, r, p.cfg.Publish+"/state", device)
+	}
+	p.announced[""] = true
+}
+
+func (p *MQTTPublisher) announceSite(site string) {
+	if p.cfg.Discovery == "" || p.announced[site] {
+		return
+	}
+	id := p.node + "_" + mqttSlug(site)
+	device := haDevice{Identifiers: []string{id}, Name: site, Model: "gridwatch site", ViaDevice: p.node}
+	for _, r := range haSite {
+		p.announce(id+"_"+r.key, r, p.siteTopic(site), device)
+	}
+	p.announced[site] = true
+}
+
+func (p *MQTTPublisher) announce(id string, r haReading, stateTopic string, device haDevice) {
+	p.send(p.cfg.Discovery+"/sensor/"+id+"/config", haSensor{
+		Name:              r.name,
+		UniqueID:          id,
+		StateTopic:        stateTopic,
+		ValueTemplate:     "{{ value_json." + r.key + " }}",
+		Unit:              r.unit,
+		DeviceClass:       r.class,
+		StateClass:        r.state,
+		AvailabilityTopic: p.cfg.Publish + "/status",
+		Device:            device,
+	})
+}
+
+// mqttSlug makes name safe as a topic level and an ID: lower case letters,
+// digits and underscores. A name with none of those is hashed.
+func mqttSlug(name string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(name) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+			underscore = false
+		} else if !underscore && b.Len() > 0 {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	if slug := strings.TrimSuffix(b.String(), "_"); slug != "" {
+		return slug
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("site_%08x", h.Sum32())
+}
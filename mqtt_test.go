@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestMQTTValue(t *testing.T) {
+	tests := []struct {
+		payload string
+		field   string
+		want    float64
+		err     bool
+	}{
+		{payload: "1250", want: 1250},
+		{payload: " -12.5\n", field: "apower", want: -12.5},
+		{payload: `{"apower": 1250.5, "voltage": 230}`, field: "apower", want: 1250.5},
+		{payload: `{"id": 0, "aenergy": {"total": 4321.5, "by_minute": [1, 2, 3]}}`, field: "aenergy.total", want: 4321.5},
+		{payload: `{"power": "800"}`, field: "power", want: 800},
+		{payload: "on", err: true},
+		{payload: `{"apower": 1250}`, field: "power", err: true},
+		{payload: `{"aenergy": 4321.5}`, field: "aenergy.total", err: true},
+		{payload: `{"apower": true}`, field: "apower", err: true},
+		{payload: `{"apower": "n/a"}`, field: "apower", err: true},
+		{payload: `[1250]`, field: "apower", err: true},
+	}
+	for _, tt := range tests {
+		got, err := mqttValue([]byte(tt.payload), tt.field)
+		if tt.err {
+			if err == nil {
+				t.Errorf("mqttValue(%q, %q) = %v, want an error", tt.payload, tt.field, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("mqttValue(%q, %q) = %v, %v, want %v", tt.payload, tt.field, got, err, tt.want)
+		}
+	}
+}
+
+// fakeMessage is a received message, as a handler sees it.
+type fakeMessage struct {
+	mqtt.Message
+	topic   string
+	payload string
+}
+
+func (m fakeMessage) Topic() string   { return m.topic }
+func (m fakeMessage) Payload() []byte { return []byte(m.payload) }
+
+func TestMQTTSourceTopics(t *testing.T) {
+	s, err := NewMQTTSource(MQTTConfig{
+		Broker:      "tcp://127.0.0.1:1883",
+		PowerTopic:  "shellies/+/status/switch:0",
+		PowerField:  "apower",
+		EnergyTopic: "meters/energy/+",
+		EnergyUnit:  "Wh",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.topics) != 2 || s.topics[0].site != 1 || s.topics[1].site != 2 {
+		t.Fatalf("topics = %+v, want the site at levels 1 and 2", s.topics)
+	}
+	power, energy := s.handler(s.topics[0]), s.handler(s.topics[1])
+
+	start := time.Now()
+	power(nil, fakeMessage{topic: "shellies/Airport/status/switch:0", payload: `{"id":0,"apower":1250}`})
+	power(nil, fakeMessage{topic: "shellies/Harbour/status/switch:0", payload: `{"id":0,"voltage":230}`})
+	energy(nil, fakeMessage{topic: "meters/energy/Airport", payload: "4321500"})
+	energy(nil, fakeMessage{topic: "meters/energy", payload: "1"})
+	energy(nil, fakeMessage{topic: "meters/energy/", payload: "1"})
+	end := time.Now()
+
+	ctx := context.Background()
+	readings, _ := s.CurrentPower(ctx, "", start.Add(-time.Nanosecond), end)
+	if len(readings) != 1 || readings["Airport"] != 1250 {
+		t.Errorf("power = %v, want Airport at 1250 W", readings)
+	}
+	readings, _ = s.MeterReadings(ctx, "", start.Add(-time.Nanosecond), end)
+	if len(readings) != 1 || readings["Airport"] != 4321.5 {
+		t.Errorf("meter readings = %v, want Airport at 4321.5 kWh", readings)
+	}
+}
+
+func TestNewMQTTSource(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  MQTTConfig
+		err  string
+	}{
+		{"no broker", MQTTConfig{PowerTopic: "meters/+/power", EnergyUnit: "kWh"}, "reading from MQTT needs a broker"},
+		{"no site level", MQTTConfig{Broker: "tcp://broker:1883", PowerTopic: "meters/airport/power", EnergyUnit: "kWh"},
+			`MQTT topic "meters/airport/power" has no + level to name the site`},
+		{"only a wildcard", MQTTConfig{Broker: "tcp://broker:1883", EnergyTopic: "meters/#", EnergyUnit: "kWh"},
+			`MQTT topic "meters/#" has no + level to name the site`},
+		{"no topics", MQTTConfig{Broker: "tcp://broker:1883", EnergyUnit: "kWh"}, "reading from MQTT needs a power or energy topic"},
+		{"bad unit", MQTTConfig{Broker: "tcp://broker:1883", PowerTopic: "meters/+/power", EnergyUnit: "MWh"}, `bad MQTT energy unit "MWh", want kWh or Wh`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMQTTSource(tt.cfg)
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("NewMQTTSource = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMQTTSlug(t *testing.T) {
+	for name, want := range map[string]string{
+		"Airport":           "airport",
+		"Big Array (north)": "big_array_north",
+		"  Harbour--West ":  "harbour_west",
+		"":                  "site_811c9dc5",
+	} {
+		if got := mqttSlug(name); got != want {
+			t.Errorf("mqttSlug(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// fakeMQTT records what is published through it.
+type fakeMQTT struct {
+	mqtt.Client
+
+	mu        sync.Mutex
+	published map[string][]byte
+	count     int
+}
+
+func (c *fakeMQTT) IsConnectionOpen() bool { return true }
+
+func (c *fakeMQTT) Publish(topic string, qos byte, retained bool, payload any) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published[topic] = payload.([]byte)
+	c.count++
+	return doneToken{}
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{}          { return closedChan }
+func (doneToken) Error() error                   { return nil }
+
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+func TestMQTTDiscovery(t *testing.T) {
+	p, err := NewMQTTPublisher(MQTTConfig{Broker: "tcp://broker:1883", ClientID: "gridwatch", Publish: "solar", Discovery: "homeassistant"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeMQTT{published: map[string][]byte{}}
+	p.client = client
+
+	state := SolarData{Time: 1700000000000, Current_w: 2500, Day_kwh: 12.5, Total_kwh: 9876, Sites: []SiteData{
+		{Name: "Big Array", Snapshot: 2000, Today: 10},
+		{Name: "Airport", Snapshot: 500, Today: 2.5},
+	}}
+	p.publish(state)
+
+	totals := haDevice{Identifiers: []string{"gridwatch"}, Name: "Island solar", Model: "gridwatch"}
+	bigArray := haDevice{Identifiers: []string{"gridwatch_big_array"}, Name: "Big Array", Model: "gridwatch site", ViaDevice: "gridwatch"}
+	airport := haDevice{Identifiers: []string{"gridwatch_airport"}, Name: "Airport", Model: "gridwatch site", ViaDevice: "gridwatch"}
+	want := map[string]haSensor{
+		"homeassistant/sensor/gridwatch_current_w/config": {"Solar power", "gridwatch_current_w", "solar/state",
+			"{{ value_json.current_w }}", "W", "power", "measurement", "solar/status", totals},
+		"homeassistant/sensor/gridwatch_day_kwh/config": {"Solar energy today", "gridwatch_day_kwh", "solar/state",
+			"{{ value_json.day_kwh }}", "kWh", "energy", "total_increasing", "solar/status", totals},
+		"homeassistant/sensor/gridwatch_total_kwh/config": {"Solar energy", "gridwatch_total_kwh", "solar/state",
+			"{{ value_json.total_kwh }}", "kWh", "energy", "total_increasing", "solar/status", totals},
+		"homeassistant/sensor/gridwatch_big_array_snapshot/config": {"Power", "gridwatch_big_array_snapshot", "solar/site/big_array/state",
+			"{{ value_json.snapshot }}", "W", "power", "measurement", "solar/status", bigArray},
+		"homeassistant/sensor/gridwatch_big_array_today/config": {"Energy today", "gridwatch_big_array_today", "solar/site/big_array/state",
+			"{{ value_json.today }}", "kWh", "energy", "total_increasing", "solar/status", bigArray},
+		"homeassistant/sensor/gridwatch_airport_snapshot/config": {"Power", "gridwatch_airport_snapshot", "solar/site/airport/state",
+			"{{ value_json.snapshot }}", "W", "power", "measurement", "solar/status", airport},
+		"homeassistant/sensor/gridwatch_airport_today/config": {"Energy today", "gridwatch_airport_today", "solar/site/airport/state",
+			"{{ value_json.today }}", "kWh", "energy", "total_increasing", "solar/status", airport},
+	}
+	for topic, sensor := range want {
+		payload, ok := client.published[topic]
+		if !ok {
+			t.Errorf("nothing announced on %s", topic)
+			continue
+		}
+		wantPayload, _ := json.Marshal(sensor)
+		if string(payload) != string(wantPayload) {
+			t.Errorf("%s announced\n%s\nwant\n%s", topic, payload, wantPayload)
+		}
+	}
+
+	var gotTotals mqttTotals
+	if err := json.Unmarshal(client.published["solar/state"], &gotTotals); err != nil || gotTotals.Current_w != 2500 || gotTotals.Time != state.Time {
+		t.Errorf("solar/state = %s, want the totals", client.published["solar/state"])
+	}
+	var gotSite SiteData
+	if err := json.Unmarshal(client.published["solar/site/big_array/state"], &gotSite); err != nil || gotSite != state.Sites[0] {
+		t.Errorf("solar/site/big_array/state = %s, want %+v", client.published["solar/site/big_array/state"], state.Sites[0])
+	}
+	if len(client.published) != len(want)+3 {
+		t.Errorf("published on %d topics, want %d", len(client.published), len(want)+3)
+	}
+
+	// announced once, until Home Assistant comes back
+	client.count = 0
+	p.publish(state)
+	if client.count != 3 {
+		t.Errorf("second update published %d messages, want only the 3 states", client.count)
+	}
+	p.reannounce.Store(true)
+	client.count = 0
+	p.publish(state)
+	if client.count != len(want)+3 {
+		t.Errorf("update after Home Assistant restarted published %d messages, want %d", client.count, len(want)+3)
+	}
+}
+
+func TestMQTTNoDiscovery(t *testing.T) {
+	p, err := NewMQTTPublisher(MQTTConfig{Broker: "tcp://broker:1883", ClientID: "gridwatch", Publish: "solar"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeMQTT{published: map[string][]byte{}}
+	p.client = client
+	p.publish(SolarData{Sites: []SiteData{{Name: "Airport"}}})
+	if len(client.published) != 2 {
+		t.Errorf("published on %v, want only the states", client.published)
+	}
+}
+
+// TestMQTTBroker runs against the broker in GRIDWATCH_TEST_MQTT_BROKER,
+// as in tcp://127.0.0.1:1883.
+func TestMQTTBroker(t *testing.T) {
+	broker := os.Getenv("GRIDWATCH_TEST_MQTT_BROKER")
+	if broker == "" {
+		t.Skip("GRIDWATCH_TEST_MQTT_BROKER not set")
+	}
+	prefix := fmt.Sprintf("gridwatch-test/%d", time.Now().UnixNano())
+	cfg := MQTTConfig{Broker: broker, ClientID: "gridwatch-test", Publish: prefix + "/out", Discovery: prefix + "/ha"}
+
+	test := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID(cfg.ClientID + "-check"))
+	if err := mqttWait(test.Connect()); err != nil {
+		t.Skipf("no MQTT broker at %s: %v", broker, err)
+	}
+	defer test.Disconnect(250)
+
+	t.Run("ingest", func(t *testing.T) {
+		cfg := cfg
+		cfg.PowerTopic, cfg.PowerField = prefix+"/in/+/power", "apower"
+		cfg.EnergyTopic, cfg.EnergyUnit = prefix+"/in/+/energy", "Wh"
+		s, err := NewMQTTSource(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			s.Run(ctx)
+			close(done)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+
+		// keep publishing until the source has subscribed
+		start := time.Now()
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			mqttWait(test.Publish(prefix+"/in/Airport/power", 0, false, `{"apower": 1250}`))
+			mqttWait(test.Publish(prefix+"/in/Airport/energy", 0, false, "4321500"))
+			power, _ := s.CurrentPower(ctx, "Airport", start, time.Now())
+			meter, _ := s.MeterReadings(ctx, "Airport", start, time.Now())
+			if power["Airport"] == 1250 && meter["Airport"] == 4321.5 {
+				return
+			}
+		}
+		t.Error("readings published to the broker never arrived")
+	})
+
+	t.Run("publish", func(t *testing.T) {
+		var mu sync.Mutex
+		received := map[string][]byte{}
+		if err := mqttWait(test.Subscribe(prefix+"/#", 1, func(c mqtt.Client, msg mqtt.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			received[msg.Topic()] = msg.Payload()
+		})); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			// clear what was retained
+			mqttWait(test.Unsubscribe(prefix + "/#"))
+			mu.Lock()
+			defer mu.Unlock()
+			for topic := range received {
+				mqttWait(test.Publish(topic, 1, true, ""))
+			}
+		}()
+
+		p, err := NewMQTTPublisher(cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.client = mqtt.NewClient(mqttOptions(cfg, cfg.ClientID+"-publish"))
+		if err := mqttWait(p.client.Connect()); err != nil {
+			t.Fatal(err)
+		}
+		defer p.client.Disconnect(250)
+		p.publish(SolarData{Current_w: 2500, Sites: []SiteData{{Name: "Airport", Snapshot: 2500}}})
+
+		topics := []string{
+			cfg.Publish + "/state",
+			cfg.Publish + "/site/airport/state",
+			cfg.Discovery + "/sensor/gridwatch_test_current_w/config",
+			cfg.Discovery + "/sensor/gridwatch_test_airport_snapshot/config",
+		}
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			mu.Lock()
+			missing := 0
+			for _, topic := range topics {
+				if received[topic] == nil {
+					missing++
+				}
+			}
+			mu.Unlock()
+			if missing == 0 {
+				break
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, topic := range topics {
+			if received[topic] == nil {
+				t.Errorf("nothing received on %s", topic)
+			}
+		}
+		var site SiteData
+		if err := json.Unmarshal(received[cfg.Publish+"/site/airport/state"], &site); err != nil || site.Snapshot != 2500 {
+			t.Errorf("site state = %s, want Airport at 2500 W", received[cfg.Publish+"/site/airport/state"])
+		}
+	})
+}
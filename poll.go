@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// defaultCoordinates, St Mary's, stands in for the sites' locations when
+// the site registry gives none.
+var defaultCoordinates = Coordinates{Latitude: 49.92, Longitude: -6.30}
+
+// PollPolicy decides when the hub polls for live data and which results are
+// worth pushing to clients.
+type PollPolicy struct {
+	cfg       PollConfig
+	locations []Coordinates
+}
+
+// NewPollPolicy uses the coordinates of the sites in registry to tell day
+// from night.
+func NewPollPolicy(cfg PollConfig, registry *SiteRegistry) (*PollPolicy, error) {
+	if cfg.Day <= 0 || cfg.Night <= 0 {
+		return nil, fmt.Errorf("poll intervals must be positive, not %v by day and %v by night", cfg.Day, cfg.Night)
+	}
+	p := &PollPolicy{cfg: cfg}
+	for _, site := range registry.Sites {
+		if site.Location != nil {
+			p.locations = append(p.locations, *site.Location)
+		}
+	}
+	if len(p.locations) == 0 {
+		p.locations = []Coordinates{defaultCoordinates}
+	}
+	return p, nil
+}
+
+// Daylight says whether the sun is up at any of the sites at t.
+func (p *PollPolicy) Daylight(t time.Time) bool {
+	for _, location := range p.locations {
+		if solarElevation(t, location) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Interval is how long data polled at t stays current.
+func (p *PollPolicy) Interval(t time.Time) time.Duration {
+	if p.Daylight(t) {
+		return p.cfg.Day
+	}
+	return p.cfg.Night
+}
+
+// Next is when to poll after a poll at t: one interval on, moved to the
+// nearest point just after a Prometheus scrape so that each poll sees fresh
+// samples.
+func (p *PollPolicy) Next(t time.Time) time.Time {
+	next := t.Add(p.Interval(t))
+	if p.cfg.Scrape > 0 {
+		next = next.Add(-p.cfg.ScrapeOffset).Round(p.cfg.Scrape).Add(p.cfg.ScrapeOffset)
+		for !next.After(t) {
+			next = next.Add(p.cfg.Scrape)
+		}
+	}
+	return next
+}
+
+// Worth says whether next should be pushed to clients that were last sent
+// prev at lastPush: because sites came or went, a site hit a new peak, some
+// power moved by more than the threshold, or clients have heard nothing
+// for the maximum silence.
+func (p *PollPolicy) Worth(prev SolarData, next SolarData, lastPush time.Time) bool {
+	if prev.Time == 0 || time.Since(lastPush) >= p.cfg.MaxSilence {
+		return true
+	}
+	if math.Abs(float64(next.Current_w-prev.Current_w)) > p.cfg.Threshold {
+		return true
+	}
+	if len(prev.Sites) != len(next.Sites) {
+		return true
+	}
+	before := map[string]SiteData{}
+	for _, site := range prev.Sites {
+		before[site.Name] = site
+	}
+	for _, site := range next.Sites {
+		old, ok := before[site.Name]
+		if !ok || (old.Max > 0 && site.Snapshot > old.Max) || math.Abs(site.Snapshot-old.Snapshot) > p.cfg.Threshold {
+			return true
+		}
+	}
+	return false
+}
+
+// solarElevation is the sun's angle above the horizon at location, in
+// degrees, using NOAA's general solar position equations.
+func solarElevation(t time.Time, location Coordinates) float64 {
+	t = t.UTC()
+	hours := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+	gamma := 2 * math.Pi / 365 * (float64(t.YearDay()-1) + (hours-12)/24)
+
+	eqTime := 229.18 * (0.000075 + 0.001868*math.Cos(gamma) - 0.032077*math.Sin(gamma) -
+		0.014615*math.Cos(2*gamma) - 0.040849*math.Sin(2*gamma))
+	decl := 0.006918 - 0.399912*math.Cos(gamma) + 0.070257*math.Sin(gamma) -
+		0.006758*math.Cos(2*gamma) + 0.000907*math.Sin(2*gamma) -
+		0.002697*math.Cos(3*gamma) + 0.00148*math.Sin(3*gamma)
+
+	solarMinutes := hours*60 + eqTime + 4*location.Longitude
+	hourAngle := (solarMinutes/4 - 180) * math.Pi / 180
+	lat := location.Latitude * math.Pi / 180
+
+	cosZenith := math.Sin(lat)*math.Sin(decl) + math.Cos(lat)*math.Cos(decl)*math.Cos(hourAngle)
+	return 90 - math.Acos(math.Max(-1, math.Min(1, cosZenith)))*180/math.Pi
+}
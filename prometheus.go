@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PrometheusSource queries Prometheus, or anything else serving its HTTP
+// API. VictoriaMetrics takes the same requests unchanged; Thanos is asked to
+// deduplicate replicas and to fail rather than answer from only some of its
+// stores, so that a partial answer isn't taken for the real figures.
+type PrometheusSource struct {
+	system   string
+	endpoint string // the instant query endpoint, .../api/v1/query
+	username string
+	password string
+	params   url.Values
+	schema   MetricSchema
+}
+
+func NewPrometheusSource(system string, endpoint string, username string, password string, schema MetricSchema) *PrometheusSource {
+	params := url.Values{}
+	if system == "thanos" {
+		params.Set("dedup", "true")
+		params.Set("partial_response", "false")
+	}
+	return &PrometheusSource{system: system, endpoint: endpoint, username: username, password: password, params: params, schema: schema}
+}
+
+func (s *PrometheusSource) MeterReadings(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return s.instant(ctx, s.schema.Selector(s.schema.Energy, site).Range("last_over_time", end.Sub(start)), end)
+}
+
+func (s *PrometheusSource) CurrentPower(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return s.instant(ctx, s.schema.Selector(s.schema.Power, site).Range("last_over_time", end.Sub(start)), end)
+}
+
+func (s *PrometheusSource) Energy(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return s.instant(ctx, s.schema.Selector(s.schema.Energy, site).Range("delta", end.Sub(start)), end)
+}
+
+func (s *PrometheusSource) PeakPower(ctx context.Context, site string, start, end time.Time) (Readings, error) {
+	return s.instant(ctx, s.schema.Selector(s.schema.Power, site).Range("max_over_time", end.Sub(start)), end)
+}
+
+func (s *PrometheusSource) PowerSeries(ctx context.Context, site string, start, end time.Time, step time.Duration) (Series, error) {
+	query := s.schema.Selector(s.schema.Power, site).Range("avg_over_time", step)
+	params := url.Values{}
+	params.Add("query", query)
+	params.Add("start", promTime(start))
+	params.Add("end", promTime(end))
+	params.Add("step", promDuration(step))
+	body, err := s.fetch(ctx, s.endpoint+"_range", params)
+	if err != nil {
+		return nil, err
+	}
+	var promResp PrometheusRangeResponse
+	if err := json.Unmarshal(body, &promResp); err != nil {
+		return nil, err
+	}
+	series := Series{}
+	for _, result := range promResp.Data.Result {
+		for _, value := range result.Values {
+			seconds, _ := value[0].(float64)
+			v, _ := strconv.ParseFloat(value[1].(string), 64)
+			name := result.Metric[s.schema.SiteLabel]
+			series[name] = append(series[name], Point{Time: time.UnixMilli(int64(seconds * 1000)), Value: v})
+		}
+	}
+	return series, nil
+}
+
+// DiscoverSites lists the sites with a series of either metric, over all
+// the data Prometheus holds, and the series without a site label.
+func (s *PrometheusSource) DiscoverSites(ctx context.Context) (sites []string, unknown []map[string]string, err error) {
+	if sites, err = s.labelValues(ctx, s.schema.SiteLabel); err != nil {
+		return nil, nil, err
+	}
+	series, err := s.series(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, labels := range series {
+		if labels[s.schema.SiteLabel] == "" {
+			unknown = append(unknown, labels)
+		}
+	}
+	return sites, unknown, nil
+}
+
+// labelValues lists the values of label on either metric.
+func (s *PrometheusSource) labelValues(ctx context.Context, label string) ([]string, error) {
+	body, err := s.fetch(ctx, s.api()+"/label/"+url.PathEscape(label)+"/values", s.matchParams())
+	if err != nil {
+		return nil, err
+	}
+	var promResp struct {
+		Data []string `json:"data"`
+	}
+	if err := json.Unmarshal(body, &promResp); err != nil {
+		return nil, err
+	}
+	return promResp.Data, nil
+}
+
+// series lists the labels of every series of either metric.
+func (s *PrometheusSource) series(ctx context.Context) ([]map[string]string, error) {
+	body, err := s.fetch(ctx, s.api()+"/series", s.matchParams())
+	if err != nil {
+		return nil, err
+	}
+	var promResp struct {
+		Data []map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(body, &promResp); err != nil {
+		return nil, err
+	}
+	return promResp.Data, nil
+}
+
+// api is the base of the HTTP API, .../api/v1.
+func (s *PrometheusSource) api() string {
+	return strings.TrimSuffix(s.endpoint, "/query")
+}
+
+// matchParams selects both metrics for the label and series APIs.
+func (s *PrometheusSource) matchParams() url.Values {
+	params := url.Values{}
+	params.Add("match[]", s.schema.Selector(s.schema.Energy, "").String())
+	params.Add("match[]", s.schema.Selector(s.schema.Power, "").String())
+	return params
+}
+
+// instant runs query as of at.
+func (s *PrometheusSource) instant(ctx context.Context, query string, at time.Time) (Readings, error) {
+	params := url.Values{}
+	params.Add("query", query)
+	params.Add("time", promTime(at))
+	body, err := s.fetch(ctx, s.endpoint, params)
+	if err != nil {
+		return nil, err
+	}
+	var promResp PrometheusSnapshotResponse
+	if err := json.Unmarshal(body, &promResp); err != nil {
+		return nil, err
+	}
+	readings := Readings{}
+	for _, result := range promResp.Data.Result {
+		readings[result.Metric[s.schema.SiteLabel]] = result.GetValue()
+	}
+	return readings, nil
+}
+
+// promDuration writes d in whole seconds, as PromQL ranges and the step
+// parameter take it.
+func promDuration(d time.Duration) string {
+	return strconv.FormatInt(max(int64(d/time.Second), 1), 10) + "s"
+}
+
+func promTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', -1, 64)
+}
+
+type PrometheusSnapshotResponse struct {
+	Data struct {
+		Result []PrometheusSnapshotData `json:"result"`
+	} `json:"data"`
+}
+
+type PrometheusSnapshotData struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value"`
+}
+
+func (p PrometheusSnapshotData) GetValue() float64 {
+	value, _ := strconv.ParseFloat(p.Value[1].(string), 64)
+	return value
+}
+
+type PrometheusRangeResponse struct {
+	Data struct {
+		Result []PrometheusRangeData `json:"result"`
+	} `json:"data"`
+}
+
+type PrometheusRangeData struct {
+	Metric map[string]string `json:"metric"`
+	Values [][]interface{}   `json:"values"`
+}
+
+// upstreamClient is shared by every upstream request.
+var upstreamClient = &http.Client{}
+
+// upstreamBreaker guards every query to a remote data source. main replaces
+// it with one built from the configuration.
+var upstreamBreaker = NewBreaker(BreakerConfig{})
+
+// QueryError is a query the data source received but could not run, or an
+// error response from it.
+type QueryError struct {
+	System     string
+	ErrorType  string
+	Message    string
+	StatusCode int
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.System, e.ErrorType, e.Message)
+}
+
+// PrometheusStatus is the envelope common to every Prometheus API response.
+type PrometheusStatus struct {
+	Status    string          `json:"status"`
+	ErrorType string          `json:"errorType"`
+	Error     string          `json:"error"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Results counts the results in the response. Queries hold them in
+// data.result, the label and series APIs in data itself.
+func (p PrometheusStatus) Results() int {
+	var list []json.RawMessage
+	if json.Unmarshal(p.Data, &list) == nil {
+		return len(list)
+	}
+	var query struct {
+		Result []json.RawMessage `json:"result"`
+	}
+	json.Unmarshal(p.Data, &query)
+	return len(query.Result)
+}
+
+// fetch runs one API request and returns the raw body. Every request is
+// logged against the caller's request with its query, duration, result
+// count and status.
+func (s *PrometheusSource) fetch(ctx context.Context, endpoint string, params url.Values) (body []byte, err error) {
+	if err := upstreamBreaker.Allow(); err != nil {
+		return nil, err
+	}
+	defer func() { upstreamBreaker.Record(err) }()
+
+	ctx, span := tracer.Start(ctx, s.system+" "+path.Base(endpoint),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", s.system),
+			attribute.String("db.statement", params.Get("query")),
+			attribute.String("server.address", endpoint),
+		),
+	)
+	defer func() { endSpan(span, err) }()
+
+	logger := LoggerFrom(ctx).With("query", params.Get("query"), "endpoint", endpoint)
+	start := time.Now()
+
+	for name, values := range s.params {
+		params[name] = values
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(s.username, s.password)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		logger.Error("prometheus query failed", "duration", time.Since(start), "err", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		logger.Error("prometheus query failed", "duration", time.Since(start), "http_status", resp.StatusCode, "err", err)
+		return nil, err
+	}
+
+	var status PrometheusStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		if resp.StatusCode >= 500 {
+			err = &QueryError{System: s.system, ErrorType: "http", Message: resp.Status, StatusCode: resp.StatusCode}
+		}
+		logger.Error("prometheus query failed", "duration", time.Since(start), "http_status", resp.StatusCode, "err", err, "body", string(body))
+		return nil, err
+	}
+	if status.Status != "success" {
+		err = &QueryError{System: s.system, ErrorType: status.ErrorType, Message: status.Error, StatusCode: resp.StatusCode}
+		logger.Error("prometheus query failed", "duration", time.Since(start), "http_status", resp.StatusCode, "status", status.Status, "err", err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("prometheus.results", status.Results()))
+	logger.Debug("prometheus query", "duration", time.Since(start), "http_status", resp.StatusCode, "status", status.Status, "results", status.Results())
+	return body, nil
+}
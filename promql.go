@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricSchema names the metrics and labels the readings are stored under.
+// The defaults match the Shelly Pro 3EM exporter the sites use.
+type MetricSchema struct {
+	Energy    string // the energy meter reading in kWh, only ever counting up
+	Power     string // power in watts
+	SiteLabel string
+	Matchers  []Matcher // every series must match these too
+}
+
+var (
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// NewMetricSchema checks cfg, whose Match is a comma separated list of
+// label matchers such as purpose=solar,job=~"shelly.*".
+func NewMetricSchema(cfg MetricsConfig) (MetricSchema, error) {
+	schema := MetricSchema{Energy: cfg.Energy, Power: cfg.Power, SiteLabel: cfg.SiteLabel}
+	for _, name := range []string{cfg.Energy, cfg.Power} {
+		if !metricName.MatchString(name) {
+			return MetricSchema{}, fmt.Errorf("bad metric name %q", name)
+		}
+	}
+	if !labelName.MatchString(cfg.SiteLabel) {
+		return MetricSchema{}, fmt.Errorf("bad site label %q", cfg.SiteLabel)
+	}
+	for _, item := range splitMatchers(cfg.Match) {
+		m, err := ParseMatcher(item)
+		if err != nil {
+			return MetricSchema{}, err
+		}
+		schema.Matchers = append(schema.Matchers, m)
+	}
+	return schema, nil
+}
+
+// Selector selects metric for site, or for every site.
+func (s MetricSchema) Selector(metric string, site string) Selector {
+	sel := Selector{Metric: metric, Matchers: s.Matchers}
+	if site != "" {
+		sel.Matchers = append(sel.Matchers[:len(sel.Matchers):len(sel.Matchers)], Matcher{Label: s.SiteLabel, Op: "=", Value: site})
+	}
+	return sel
+}
+
+// Matcher is one label matcher of a selector.
+type Matcher struct {
+	Label string
+	Op    string // =, !=, =~ or !~
+	Value string
+
+	re *regexp.Regexp // for =~ and !~, anchored as Prometheus anchors it
+}
+
+// ParseMatcher reads a matcher such as job="shelly" or instance!~"10\\..*".
+// The value may be left unquoted if it has no commas or quotes.
+func ParseMatcher(s string) (Matcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i <= 0 {
+		return Matcher{}, fmt.Errorf("bad matcher %q", s)
+	}
+	m := Matcher{Label: strings.TrimSpace(s[:i])}
+	rest := s[i:]
+	for _, op := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(rest, op) {
+			m.Op, rest = op, strings.TrimSpace(rest[len(op):])
+			break
+		}
+	}
+	if m.Op == "" || !labelName.MatchString(m.Label) {
+		return Matcher{}, fmt.Errorf("bad matcher %q", s)
+	}
+	m.Value = rest
+	if strings.HasPrefix(rest, `"`) {
+		value, err := strconv.Unquote(rest)
+		if err != nil {
+			return Matcher{}, fmt.Errorf("bad matcher %q: %w", s, err)
+		}
+		m.Value = value
+	} else if strings.Contains(rest, `"`) {
+		return Matcher{}, fmt.Errorf("bad matcher %q: quotes in an unquoted value", s)
+	}
+	if m.Op == "=~" || m.Op == "!~" {
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return Matcher{}, fmt.Errorf("bad matcher %q: %w", s, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// splitMatchers splits a list of matchers at each comma outside quotes.
+func splitMatchers(list string) (items []string) {
+	quoted := false
+	start := 0
+	add := func(item string) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	for i := 0; i < len(list); i++ {
+		switch {
+		case list[i] == '\\' && quoted:
+			i++
+		case list[i] == '"':
+			quoted = !quoted
+		case list[i] == ',' && !quoted:
+			add(list[start:i])
+			start = i + 1
+		}
+	}
+	add(list[min(start, len(list)):])
+	return items
+}
+
+// Matches says whether a series with value for the label is selected. A
+// missing label has the value "".
+func (m Matcher) Matches(value string) bool {
+	switch m.Op {
+	case "=":
+		return value == m.Value
+	case "!=":
+		return value != m.Value
+	case "=~":
+		return m.re.MatchString(value)
+	}
+	return !m.re.MatchString(value)
+}
+
+// String writes m as PromQL.
+func (m Matcher) String() string {
+	return m.Label + m.Op + quotePromQL(m.Value)
+}
+
+// Selector is a PromQL instant vector selector.
+type Selector struct {
+	Metric   string
+	Matchers []Matcher
+}
+
+func (s Selector) String() string {
+	matchers := make([]string, len(s.Matchers))
+	for i, m := range s.Matchers {
+		matchers[i] = m.String()
+	}
+	return s.Metric + "{" + strings.Join(matchers, ", ") + "}"
+}
+
+// Range applies the range function fn to sel over d, as in
+// max_over_time(power{site="Airport"}[1d]).
+func (s Selector) Range(fn string, d time.Duration) string {
+	return fmt.Sprintf("%s(%s[%s])", fn, s, promDuration(d))
+}
+
+// quotePromQL quotes s as a PromQL string. PromQL reads strings with Go's
+// escapes, so quotes, backslashes and control characters are escaped while
+// accents and other printable characters pass through.
+func quotePromQL(s string) string {
+	return strconv.Quote(s)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestQuotePromQL(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Airport", `"Airport"`},
+		{"St Mary's", `"St Mary's"`},
+		{"Porthcressa Café", `"Porthcressa Café"`},
+		{`C:\meters`, `"C:\\meters"`},
+		{`the "old" school`, `"the \"old\" school"`},
+		{"${site}", `"${site}"`},
+		{"a,b", `"a,b"`},
+		{"line\nbreak\x00", `"line\nbreak\x00"`},
+	}
+	for _, tt := range tests {
+		if got := quotePromQL(tt.in); got != tt.want {
+			t.Errorf("quotePromQL(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseMatcher(t *testing.T) {
+	tests := []struct {
+		in     string
+		label  string
+		op     string
+		value  string
+		promql string // as written back out
+	}{
+		{`job="shelly"`, "job", "=", "shelly", `job="shelly"`},
+		{`job=shelly`, "job", "=", "shelly", `job="shelly"`},
+		{` site != "Holy Vale" `, "site", "!=", "Holy Vale", `site!="Holy Vale"`},
+		{`site="St Mary's"`, "site", "=", "St Mary's", `site="St Mary's"`},
+		{`site=St Mary's`, "site", "=", "St Mary's", `site="St Mary's"`},
+		{`site="Porthcressa Café"`, "site", "=", "Porthcressa Café", `site="Porthcressa Café"`},
+		{`path="C:\\meters"`, "path", "=", `C:\meters`, `path="C:\\meters"`},
+		{`name="the \"old\" school"`, "name", "=", `the "old" school`, `name="the \"old\" school"`},
+		{`site="${site}"`, "site", "=", "${site}", `site="${site}"`},
+		{`site="Airport, east"`, "site", "=", "Airport, east", `site="Airport, east"`},
+		{`instance=~"10\\..*"`, "instance", "=~", `10\..*`, `instance=~"10\\..*"`},
+		{`instance!~"test.*"`, "instance", "!~", "test.*", `instance!~"test.*"`},
+	}
+	for _, tt := range tests {
+		m, err := ParseMatcher(tt.in)
+		if err != nil {
+			t.Errorf("ParseMatcher(%s): %v", tt.in, err)
+			continue
+		}
+		if m.Label != tt.label || m.Op != tt.op || m.Value != tt.value {
+			t.Errorf("ParseMatcher(%s) = %s %s %q, want %s %s %q", tt.in, m.Label, m.Op, m.Value, tt.label, tt.op, tt.value)
+		}
+		if got := m.String(); got != tt.promql {
+			t.Errorf("ParseMatcher(%s) written as %s, want %s", tt.in, got, tt.promql)
+		}
+	}
+
+	for _, in := range []string{
+		``,
+		`job`,
+		`="shelly"`,
+		`1job="shelly"`,
+		`job=="shelly"`,
+		`site="unterminated`,
+		`site="bad \q escape"`,
+		`instance=~"("`,
+	} {
+		if m, err := ParseMatcher(in); err == nil {
+			t.Errorf("ParseMatcher(%s) = %+v, want an error", in, m)
+		}
+	}
+}
+
+func TestMatcherMatches(t *testing.T) {
+	tests := []struct {
+		matcher string
+		value   string
+		want    bool
+	}{
+		{`site="St Mary's"`, "St Mary's", true},
+		{`site="St Mary's"`, "St Marys", false},
+		{`site!="Porthcressa Café"`, "Porthcressa Cafe", true},
+		{`site=~"Porth.*"`, "Porthcressa Café", true},
+		// regular expressions are anchored
+		{`site=~"Vale"`, "Holy Vale", false},
+		{`instance!~"10\\..*"`, "10.0.0.1", false},
+		{`instance!~"10\\..*"`, "1000", true},
+		{`site=""`, "", true},
+	}
+	for _, tt := range tests {
+		m, err := ParseMatcher(tt.matcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Matches(tt.value); got != tt.want {
+			t.Errorf("%s matching %q = %v, want %v", tt.matcher, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSplitMatchers(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{``, nil},
+		{`job="shelly"`, []string{`job="shelly"`}},
+		{`job="shelly", site!="Airport",`, []string{`job="shelly"`, `site!="Airport"`}},
+		{`site="Airport, east",job=shelly`, []string{`site="Airport, east"`, `job=shelly`}},
+		{`name="say \"hi, there\"", job=x`, []string{`name="say \"hi, there\""`, `job=x`}},
+		{`path="C:\\", job=x`, []string{`path="C:\\"`, `job=x`}},
+		{`site="St Mary's", site!="Café, Tresco"`, []string{`site="St Mary's"`, `site!="Café, Tresco"`}},
+		{`site="${a},${b}"`, []string{`site="${a},${b}"`}},
+		{` , ,job=x`, []string{`job=x`}},
+		{`site="unterminated, job=x`, []string{`site="unterminated, job=x`}},
+	}
+	for _, tt := range tests {
+		if got := splitMatchers(tt.in); !slices.Equal(got, tt.want) {
+			t.Errorf("splitMatchers(%s) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
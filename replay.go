@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ReplayClock runs through a past day faster than real time, starting
+// again from midnight when it reaches the end.
+type ReplayClock struct {
+	day     time.Time // midnight at the start of the day
+	speed   float64
+	started time.Time
+}
+
+// NewReplayClock replays day, given as 2006-01-02 in local time, at speed
+// times real time.
+func NewReplayClock(day string, speed float64) (*ReplayClock, error) {
+	midnight, err := time.ParseInLocation(time.DateOnly, day, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("bad replay day: %w", err)
+	}
+	if speed <= 0 {
+		return nil, fmt.Errorf("replay speed must be positive, not %v", speed)
+	}
+	if !midnight.AddDate(0, 0, 1).Before(time.Now()) {
+		return nil, fmt.Errorf("replay day %s isn't over yet", day)
+	}
+	return &ReplayClock{day: midnight, speed: speed, started: time.Now()}, nil
+}
+
+// Now is the simulated time.
+func (c *ReplayClock) Now() time.Time {
+	length := c.day.AddDate(0, 0, 1).Sub(c.day)
+	elapsed := time.Duration(float64(time.Since(c.started)) * c.speed)
+	return c.day.Add(elapsed % length)
+}
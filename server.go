@@ -1,181 +1,393 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
-	"regexp"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
 func main() {
-	port_env := os.Getenv("GRIDWATCH_PORT")
-	if port_env == "" {
-		port_env = "1323"
-	}
-	port := flag.String("port", port_env, "Port to run on")
+	cfg := LoadConfig()
 
-	host_env := os.Getenv("GRIDWATCH_HOST")
-	if host_env == "" {
-		host_env = "localhost"
+	logger, err := NewLogger(cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		fatal("bad logging config", err)
 	}
-	host := flag.String("host", host_env, "Host to listen on")
+	slog.SetDefault(logger)
 
-	username_env := os.Getenv("GRIDWATCH_USERNAME")
-	if username_env == "" {
-		username_env = "admin"
+	shutdownTracing, err := SetupTracing(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal("bad tracing config", err)
 	}
-	username := flag.String("username", username_env, "Username for Prometheus Server")
 
-	password_env := os.Getenv("GRIDWATCH_PASSWORD")
-	if password_env == "" {
-		password_env = "password"
+	sites, err := LoadSiteRegistry(cfg.SitesFile)
+	if err != nil {
+		fatal("failed to load sites file", err)
 	}
-	password := flag.String("password", password_env, "Password for Prometheus Server")
 
-	prom_url_env := os.Getenv("GRIDWATCH_PROM_URL")
-	if prom_url_env == "" {
-		prom_url_env = "http://localhost:9090"
+	upstreamBreaker = NewBreaker(cfg.Breaker)
+	source, err := NewDataSource(cfg, sites)
+	if err != nil {
+		fatal("bad data source config", err)
 	}
-	prom_url := flag.String("prometheus", prom_url_env, "URL for Prometheus Server")
-
-	est_DNC_env := os.Getenv("GRIDWATCH_ESTIMATED_DNC")
-	if est_DNC_env == "" {
-		est_DNC_env = "500"
+	var inverters *SunSpecSource
+	if len(cfg.Inverters.Devices) > 0 {
+		if inverters, err = NewSunSpecSource(cfg.Inverters, sites); err != nil {
+			fatal("bad inverter config", err)
+		}
+		source = MergeSources(source, inverters)
 	}
-
-	est_DNC_flag := flag.String("estimate", est_DNC_env, "Estimated unmonitored solar capacity in kilowatts")
-	est_DNC, err := strconv.Atoi(*est_DNC_flag)
-	if err != nil {
-		est_DNC = 500
+	// readings published over MQTT are taken alongside the data source's
+	if cfg.Source != "mqtt" && (cfg.MQTT.PowerTopic != "" || cfg.MQTT.EnergyTopic != "") {
+		mqttSource, err := NewMQTTSource(cfg.MQTT)
+		if err != nil {
+			fatal("bad MQTT config", err)
+		}
+		source = MergeSources(source, mqttSource)
 	}
-
-	monitored_DNC_env := os.Getenv("GRIDWATCH_DNC")
-	if monitored_DNC_env == "" {
-		monitored_DNC_env = "20"
+	var clock func() time.Time
+	if cfg.Replay.Day != "" {
+		if cfg.Fixtures != "" {
+			fatal("bad replay config", errors.New("a replay needs the data source, not fixtures"))
+		}
+		replay, err := NewReplayClock(cfg.Replay.Day, cfg.Replay.Speed)
+		if err != nil {
+			fatal("bad replay config", err)
+		}
+		clock = replay.Now
+		// the sun the poll policy sees isn't the replayed one, and there
+		// are no fresh scrapes to wait for
+		cfg.Poll.Night = cfg.Poll.Day
+		cfg.Poll.Scrape = 0
+		slog.Info("replaying a past day", "day", cfg.Replay.Day, "speed", cfg.Replay.Speed)
 	}
-	monitored_DNC_flag := flag.String("dnc", monitored_DNC_env, "Monitored solar capacity in kilowatts")
-	monitored_DNC, err := strconv.Atoi(*monitored_DNC_flag)
-	if err != nil {
-		monitored_DNC = 20
+	// sites are discovered from the data source where it can list them,
+	// so that a site isn't missed for being quiet; a replayed day has the
+	// sites it had
+	var discovery *Discovery
+	var knownSites func() []string
+	if discoverer, ok := source.(SiteDiscoverer); ok && cfg.Discovery > 0 && cfg.Replay.Day == "" {
+		discovery = NewDiscovery(discoverer, sites)
+		knownSites = discovery.Sites
+	}
+	service := NewLiveService(source, clock, knownSites, cfg.EstimatedDNC, cfg.MonitoredDNC)
+	if cfg.Fixtures != "" {
+		if service, err = NewFixtureService(cfg.Fixtures); err != nil {
+			fatal("failed to load fixtures", err)
+		}
+		slog.Info("serving recorded fixtures", "dir", cfg.Fixtures)
+	}
+	if cfg.Record != "" {
+		if service, err = NewRecordingService(service, cfg.Record); err != nil {
+			fatal("failed to start recording", err)
+		}
+		slog.Info("recording fixtures", "dir", cfg.Record)
 	}
-
-	flag.Parse()
 
 	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+
+	ipExtractor, err := IPExtractor(cfg.TrustedProxies)
+	if err != nil {
+		fatal("bad trusted proxies", err)
+	}
+	e.IPExtractor = ipExtractor
+	rateLimit := RateLimitMiddleware(cfg.RateLimit)
+	streams := NewStreamLimiter(cfg.MaxStreams, cfg.MaxStreamsPerIP)
 
 	e.Use(middleware.Recover())
+	e.Use(TracingMiddleware())
+	e.Use(RequestLogging()...)
+	e.Use(CORSMiddleware(cfg.CORS))
+	if cfg.Security.Enabled {
+		e.Use(SecurityMiddleware(cfg.Security, cfg.APIBase))
+	}
 
-	e.GET("/sse", func(c echo.Context) error {
-		log.Printf("SSE client connected, ip:%v", c.RealIP())
-		w := c.Response()
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+	// closed when the server starts shutting down so that long-lived SSE and
+	// WebSocket streams can say goodbye instead of holding up Shutdown
+	sseShutdown, stopSSE := context.WithCancel(context.Background())
+	e.Server.RegisterOnShutdown(stopSSE)
+	e.TLSServer.RegisterOnShutdown(stopSSE)
 
-		send := func() error {
-			solarData, err := get_solar_data(*username, *password, *prom_url, est_DNC, monitored_DNC)
-			if err != nil {
-				log.Print("Error:", err)
-				return err
-			}
-			data, jsonErr := json.Marshal(solarData)
-			if jsonErr != nil {
-				log.Print("Error:", jsonErr)
-				return jsonErr
-			}
-			event := Event{
-				Data: []byte(data),
-			}
-			if err := event.MarshalTo(w); err != nil {
-				return err
-			}
-			w.Flush()
-			return nil
-		}
+	if collector, ok := source.(Collector); ok && cfg.Fixtures == "" {
+		go collector.Run(sseShutdown)
+	}
+	if discovery != nil {
+		go discovery.Run(sseShutdown, cfg.Discovery)
+	}
 
-		// send initial event
-		if err := send(); err != nil {
-			return nil
+	policy, err := NewPollPolicy(cfg.Poll, sites)
+	if err != nil {
+		fatal("bad poll config", err)
+	}
+	hub := NewHub(func(ctx context.Context) (SolarData, error) {
+		return service.SolarData(ctx, time.Time{})
+	}, policy, cfg.ReplayBuffer)
+	go hub.Run(sseShutdown)
+	if cfg.MQTT.Publish != "" {
+		publisher, err := NewMQTTPublisher(cfg.MQTT, hub)
+		if err != nil {
+			fatal("bad MQTT config", err)
 		}
+		go publisher.Run(sseShutdown)
+	}
 
-		ticker := time.NewTicker(60 * time.Second)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-c.Request().Context().Done():
-				log.Printf("SSE client disconnected, ip:%v", c.RealIP())
-				return nil
-			case <-ticker.C:
-				if err := send(); err != nil {
-					return nil
-				}
-			}
-		}
-	})
+	e.GET("/sse", ServeSSE(hub, sseShutdown, cfg.SSE, sites), streams.Middleware())
+	var sockets sync.WaitGroup
+	e.GET("/ws", ServeWS(hub, sseShutdown, cfg.SSE, sites, cfg.CORS.AllowOrigins, &sockets), streams.Middleware())
 
-	var validSite = regexp.MustCompile(`^[a-zA-Z0-9_+-]+$`)
+	// answers for while the data source is down
+	lastGoodSite := NewLastGood[SitePeriodData]()
+	lastGoodSites := NewLastGood[[]SitePeriodData]()
+	lastGoodToday := NewLastGood[PeriodData]()
 
 	e.GET("/site/:site/:period", func(c echo.Context) error {
-		siteName := c.Param("site")
-		if !validSite.MatchString(siteName) {
-			log.Print("Error: Bad Route")
+		siteName, ok := siteParam(c)
+		if !ok {
+			LoggerFrom(c.Request().Context()).Warn("bad route", "site", c.Param("site"))
 			return c.JSON(http.StatusBadRequest, map[string]string{"message": "bad route"})
 		}
 		period, err := strconv.ParseInt(c.Param("period"), 10, 64)
-		w := c.Response()
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-
+		if err == nil && (period < 1 || period > maxPeriodDays) {
+			err = fmt.Errorf("period of %d days isn't between 1 and %d", period, maxPeriodDays)
+		}
 		if err != nil {
-			log.Print("Error: ", err)
+			LoggerFrom(c.Request().Context()).Warn("bad period", "err", err)
 			return c.JSON(http.StatusBadRequest, map[string]string{"message": "bad period"})
 		}
 
+		at, err := ParseAt(c.QueryParam("at"))
+		if err != nil {
+			LoggerFrom(c.Request().Context()).Warn("bad at", "err", err)
+			return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+		}
+
+		key := siteName + "/" + strconv.FormatInt(period, 10)
+		if !at.IsZero() {
+			key += "@" + strconv.FormatInt(at.UnixMilli(), 10)
+		}
 		if siteName == "all" {
-			site_data, err := FetchPeriodData(*username, *password, *prom_url, int(period))
+			site_data, err := service.Period(c.Request().Context(), int(period), at)
 			if err != nil {
-				log.Print("Error: ", err)
+				if stale, age, ok := lastGoodSites.Fallback(key, err); ok {
+					LoggerFrom(c.Request().Context()).Warn("answering with last good data", "err", err, "age", age)
+					stale = slices.Clone(stale)
+					for i := range stale {
+						stale[i].Stale, stale[i].Age = true, age.Milliseconds()
+					}
+					return c.JSON(http.StatusOK, stale)
+				}
+				if errors.Is(err, os.ErrNotExist) {
+					return c.JSON(http.StatusNotFound, map[string]string{"message": "not recorded"})
+				}
+				LoggerFrom(c.Request().Context()).Error("site query failed", "err", err)
 				return c.JSON(http.StatusBadGateway, map[string]string{"message": "bad query"})
 			}
+			lastGoodSites.Put(key, site_data)
 
 			return c.JSON(http.StatusOK, site_data)
 		} else {
-			site_data, err := FetchSitePeriodData(*username, *password, *prom_url, siteName, int(period))
+			site_data, err := service.SitePeriod(c.Request().Context(), siteName, int(period), at)
 			if err != nil {
-				log.Print("Error: ", err)
+				if stale, age, ok := lastGoodSite.Fallback(key, err); ok {
+					LoggerFrom(c.Request().Context()).Warn("answering with last good data", "err", err, "age", age)
+					stale.Stale, stale.Age = true, age.Milliseconds()
+					return c.JSON(http.StatusOK, stale)
+				}
+				if errors.Is(err, os.ErrNotExist) {
+					return c.JSON(http.StatusNotFound, map[string]string{"message": "not recorded"})
+				}
+				LoggerFrom(c.Request().Context()).Error("site query failed", "err", err)
 				return c.JSON(http.StatusBadGateway, map[string]string{"message": "bad query"})
 			}
+			lastGoodSite.Put(key, site_data)
 
 			return c.JSON(http.StatusOK, site_data)
 		}
-	})
+	}, rateLimit)
 
 	e.GET("/site/all", func(c echo.Context) error {
-		w := c.Response()
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		at, err := ParseAt(c.QueryParam("at"))
+		if err != nil {
+			LoggerFrom(c.Request().Context()).Warn("bad at", "err", err)
+			return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+		}
 
-		site_data, err := FetchTodaysGenerationData(*username, *password, *prom_url)
+		key := "today"
+		if !at.IsZero() {
+			key += "@" + strconv.FormatInt(at.UnixMilli(), 10)
+		}
+		site_data, err := service.TodaysGeneration(c.Request().Context(), at)
 		if err != nil {
-			if strings.Contains(err.Error(), "empty dataset") {
+			if errors.Is(err, errEmptyDataset) {
 				return c.JSON(http.StatusOK, PeriodData{})
 			}
-			log.Print("Error: ", err)
+			if stale, age, ok := lastGoodToday.Fallback(key, err); ok {
+				LoggerFrom(c.Request().Context()).Warn("answering with last good data", "err", err, "age", age)
+				stale.Stale, stale.Age = true, age.Milliseconds()
+				return c.JSON(http.StatusOK, stale)
+			}
+			if errors.Is(err, os.ErrNotExist) {
+				return c.JSON(http.StatusNotFound, map[string]string{"message": "not recorded"})
+			}
+			LoggerFrom(c.Request().Context()).Error("today's generation query failed", "err", err)
 			return c.JSON(http.StatusBadGateway, map[string]string{"message": "bad query"})
 		}
+		lastGoodToday.Put(key, site_data)
 
 		return c.JSON(http.StatusOK, site_data)
-	})
+	}, rateLimit)
+
+	// the live state as of a moment, now by default
+	e.GET("/summary", func(c echo.Context) error {
+		at, err := ParseAt(c.QueryParam("at"))
+		if err != nil {
+			LoggerFrom(c.Request().Context()).Warn("bad at", "err", err)
+			return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+		}
+		state, err := service.SolarData(c.Request().Context(), at)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return c.JSON(http.StatusNotFound, map[string]string{"message": "not recorded"})
+			}
+			LoggerFrom(c.Request().Context()).Error("summary query failed", "err", err)
+			return c.JSON(http.StatusBadGateway, map[string]string{"message": "bad query"})
+		}
+		return c.JSON(http.StatusOK, state)
+	}, rateLimit)
+
+	// what discovery found and the inverters' own readings name sites and
+	// label sets the dashboard doesn't, so they are only for the operator
+	if cfg.AdminToken != "" {
+		admin := e.Group("/admin", rateLimit, AdminMiddleware(cfg.AdminToken))
+
+		// what discovery found, and how it differs from the registry
+		admin.GET("/sites", func(c echo.Context) error {
+			if discovery == nil {
+				return c.JSON(http.StatusNotFound, map[string]string{"message": "site discovery is off"})
+			}
+			return c.JSON(http.StatusOK, discovery.Report())
+		})
+
+		// the latest from each inverter, including what the sites don't show
+		admin.GET("/inverters", func(c echo.Context) error {
+			if inverters == nil {
+				return c.JSON(http.StatusNotFound, map[string]string{"message": "no inverters configured"})
+			}
+			return c.JSON(http.StatusOK, inverters.Inverters())
+		})
+	}
+
+	if cfg.ServeUI {
+		frontend, err := NewFrontend(FrontendConfig{
+			Server: cfg.APIBase,
+			Poll:   FrontendPoll{DayMs: cfg.Poll.Day.Milliseconds(), NightMs: cfg.Poll.Night.Milliseconds()},
+		})
+		if err != nil {
+			fatal("loading dashboard failed", err)
+		}
+		frontend.Register(e)
+	}
 
-	listen_on := fmt.Sprintf("%s:%s", *host, *port)
-	e.Logger.Fatal(e.Start(listen_on))
+	listen_on := fmt.Sprintf("%s:%s", cfg.Host, cfg.Port)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := e.Server
+	var redirect *http.Server
+	if cfg.TLS.CertFile != "" {
+		certs, err := NewCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			fatal("loading TLS certificate failed", err)
+		}
+		if cfg.TLS.ReloadInterval > 0 {
+			go certs.Watch(ctx, cfg.TLS.ReloadInterval)
+		}
+
+		server = e.TLSServer
+		server.TLSConfig = certs.TLSConfig()
+
+		if cfg.TLS.RedirectAddr != "" {
+			redirect = NewRedirectServer(cfg.TLS.RedirectAddr, cfg.Port)
+			go func() {
+				if err := redirect.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					e.Logger.Fatal(err)
+				}
+			}()
+		}
+	}
+	server.Addr = listen_on
+	slog.Info("listening", "addr", listen_on, "tls", server.TLSConfig != nil)
+
+	go func() {
+		if err := e.StartServer(server); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down", "grace", cfg.ShutdownGrace)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGrace)
+	defer cancel()
+	if redirect != nil {
+		redirect.Shutdown(shutdownCtx)
+	}
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		fatal("shutdown failed", err)
+	}
+	// WebSocket connections are hijacked, so Shutdown doesn't wait for them
+	socketsClosed := make(chan struct{})
+	go func() {
+		sockets.Wait()
+		close(socketsClosed)
+	}()
+	select {
+	case <-socketsClosed:
+	case <-shutdownCtx.Done():
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("flushing traces failed", "err", err)
+	}
+	slog.Info("server stopped")
+}
+
+// siteParam reads the site a route names. Site names may have spaces,
+// apostrophes and accents, so anything is allowed but control characters
+// and what would step out of a fixtures directory.
+func siteParam(c echo.Context) (string, bool) {
+	site := c.Param("site")
+	// echo leaves params escaped when the path isn't in its usual escaping
+	if c.Request().URL.RawPath != "" {
+		var err error
+		if site, err = url.PathUnescape(site); err != nil {
+			return "", false
+		}
+	}
+	if site == "" || site == "." || site == ".." || len(site) > 200 || !utf8.ValidString(site) {
+		return "", false
+	}
+	if strings.ContainsFunc(site, func(r rune) bool { return r == '/' || r == '\\' || unicode.IsControl(r) }) {
+		return "", false
+	}
+	return site, true
 }
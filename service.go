@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Service produces the data behind each of gridwatch's routes: the live
+// state, today's generation and the per-site periods. Each is worked out
+// as of at, or now if at is zero.
+type Service interface {
+	SolarData(ctx context.Context, at time.Time) (SolarData, error)
+	TodaysGeneration(ctx context.Context, at time.Time) (PeriodData, error)
+	SitePeriod(ctx context.Context, site string, days int, at time.Time) (SitePeriodData, error)
+	Period(ctx context.Context, days int, at time.Time) ([]SitePeriodData, error)
+}
+
+// ParseAt reads an at parameter, an RFC 3339 time or unix seconds as
+// Prometheus takes them. An empty value means now, the zero time.
+func ParseAt(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		seconds, parseErr := strconv.ParseFloat(value, 64)
+		if parseErr != nil {
+			return time.Time{}, errors.New("at must be an RFC 3339 time or unix seconds")
+		}
+		at = time.UnixMilli(int64(seconds * 1000))
+	}
+	if at.After(time.Now()) {
+		return time.Time{}, errors.New("at is in the future")
+	}
+	// days start at local midnight whatever zone at was given in
+	return at.In(time.Local), nil
+}
+
+// liveService works everything out from a DataSource, as of the time
+// clock gives.
+type liveService struct {
+	source       DataSource
+	clock        func() time.Time
+	sites        func() []string
+	estDNC       int
+	monitoredDNC int
+}
+
+// NewLiveService answers as of clock, time.Now if nil. The live state
+// lists every site sites returns, if it isn't nil, whether or not it has
+// readings.
+func NewLiveService(source DataSource, clock func() time.Time, sites func() []string, estDNC int, monitoredDNC int) Service {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &liveService{source: source, clock: clock, sites: sites, estDNC: estDNC, monitoredDNC: monitoredDNC}
+}
+
+func (s *liveService) SolarData(ctx context.Context, at time.Time) (SolarData, error) {
+	var known []string
+	// the sites known now may not have been then
+	if s.sites != nil && at.IsZero() {
+		known = s.sites()
+	}
+	return get_solar_data(ctx, s.source, s.now(at), known, s.estDNC, s.monitoredDNC)
+}
+
+func (s *liveService) TodaysGeneration(ctx context.Context, at time.Time) (PeriodData, error) {
+	return FetchTodaysGenerationData(ctx, s.source, s.now(at))
+}
+
+func (s *liveService) SitePeriod(ctx context.Context, site string, days int, at time.Time) (SitePeriodData, error) {
+	return FetchSitePeriodData(ctx, s.source, site, days, s.now(at))
+}
+
+func (s *liveService) Period(ctx context.Context, days int, at time.Time) ([]SitePeriodData, error) {
+	return FetchPeriodData(ctx, s.source, days, s.now(at))
+}
+
+func (s *liveService) now(at time.Time) time.Time {
+	if at.IsZero() {
+		return s.clock()
+	}
+	return at
+}
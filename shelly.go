@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShellySource reads Shelly Pro 3EM energy meters directly over their
+// local RPC API, rather than through a Prometheus exporter. Each site has
+// one meter, polled for its power and energy totals. Only the last
+// cfg.History of readings is kept, so energy and peak power over longer
+// periods have no answer for its sites, though meter readings are always
+// the latest.
+type ShellySource struct {
+	*MemorySource
+
+	devices  []*shellyDevice
+	interval time.Duration
+	history  time.Duration
+}
+
+type shellyDevice struct {
+	site    string
+	addr    string // base URL, http://host[:port]
+	failing bool   // only touched by the poll
+}
+
+// NewShellySource reads cfg.Devices, each a site name and the meter's
+// address, as in Airport=192.168.1.20. An address may give a scheme and
+// port, as in Airport=http://127.0.0.1:8091.
+func NewShellySource(cfg ShellyConfig) (*ShellySource, error) {
+	if len(cfg.Devices) == 0 {
+		return nil, fmt.Errorf("the shelly source needs at least one device")
+	}
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("the shelly poll interval must be positive")
+	}
+	s := &ShellySource{MemorySource: NewMemorySource(), interval: cfg.Interval, history: cfg.History}
+	for _, device := range cfg.Devices {
+		site, addr, ok := strings.Cut(device, "=")
+		site, addr = strings.TrimSpace(site), strings.TrimSpace(addr)
+		if !ok || site == "" || addr == "" {
+			return nil, fmt.Errorf("bad shelly device %q, want site=address", device)
+		}
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		s.devices = append(s.devices, &shellyDevice{site: site, addr: strings.TrimSuffix(addr, "/")})
+	}
+	return s, nil
+}
+
+// DiscoverSites lists every configured site, read yet or not.
+func (s *ShellySource) DiscoverSites(ctx context.Context) ([]string, []map[string]string, error) {
+	sites := make([]string, len(s.devices))
+	for i, device := range s.devices {
+		sites[i] = device.site
+	}
+	return sites, nil, nil
+}
+
+// Run polls every meter each interval until ctx is done.
+func (s *ShellySource) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for now := time.Now(); ; {
+		s.poll(ctx, now)
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+	}
+}
+
+// poll reads every meter at once, taking the readings to be from now, then
+// forgets readings older than the history.
+func (s *ShellySource) poll(ctx context.Context, now time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, min(s.interval, fetchTimeout))
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, device := range s.devices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.read(ctx, device, now)
+			switch {
+			case err != nil && !device.failing:
+				slog.Warn("reading shelly meter failed", "site", device.site, "addr", device.addr, "err", err)
+			case err == nil && device.failing:
+				slog.Info("reading shelly meter again", "site", device.site, "addr", device.addr)
+			}
+			device.failing = err != nil
+		}()
+	}
+	wg.Wait()
+	if s.history > 0 {
+		s.Forget(now.Add(-s.history))
+	}
+}
+
+// shellyEMStatus is the part of EM.GetStatus gridwatch reads.
+type shellyEMStatus struct {
+	TotalActPower float64 `json:"total_act_power"` // watts, over all phases
+}
+
+// shellyEMDataStatus is the part of EMData.GetStatus gridwatch reads.
+type shellyEMDataStatus struct {
+	TotalAct float64 `json:"total_act"` // Wh, over all phases
+}
+
+// read takes one reading from device, stamping it with at.
+func (s *ShellySource) read(ctx context.Context, device *shellyDevice, at time.Time) error {
+	var em shellyEMStatus
+	if err := shellyRPC(ctx, device.addr, "EM.GetStatus", &em); err != nil {
+		return err
+	}
+	var data shellyEMDataStatus
+	if err := shellyRPC(ctx, device.addr, "EMData.GetStatus", &data); err != nil {
+		return err
+	}
+	s.Add(device.site, MeasurePower, Point{Time: at, Value: em.TotalActPower})
+	s.Add(device.site, MeasureMeter, Point{Time: at, Value: data.TotalAct / 1000})
+	return nil
+}
+
+// shellyError is the body of a failed RPC call.
+type shellyError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// shellyRPC calls method on the meter's first energy meter component and
+// decodes the result into v.
+func shellyRPC(ctx context.Context, addr string, method string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", addr+"/rpc/"+method+"?id=0", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var rpcErr shellyError
+		if json.NewDecoder(resp.Body).Decode(&rpcErr) != nil || rpcErr.Message == "" {
+			return &QueryError{System: "shelly", ErrorType: "http", Message: method + ": " + resp.Status, StatusCode: resp.StatusCode}
+		}
+		return &QueryError{System: "shelly", ErrorType: "rpc", Message: fmt.Sprintf("%s: %s (%d)", method, rpcErr.Message, rpcErr.Code), StatusCode: resp.StatusCode}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	return nil
+}
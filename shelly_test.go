@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeShelly answers the two RPC calls gridwatch makes as a Pro 3EM would.
+type fakeShelly struct {
+	mu       sync.Mutex
+	power    float64 // W
+	total    float64 // Wh
+	status   int     // answered instead of the readings, if not 0
+	body     string
+	requests []string
+}
+
+func (f *fakeShelly) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r.URL.RequestURI())
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		w.Write([]byte(f.body))
+		return
+	}
+	switch r.URL.Path {
+	case "/rpc/EM.GetStatus":
+		json.NewEncoder(w).Encode(map[string]any{"id": 0, "a_act_power": f.power / 3, "total_act_power": f.power})
+	case "/rpc/EMData.GetStatus":
+		json.NewEncoder(w).Encode(map[string]any{"id": 0, "a_total_act_energy": f.total / 3, "total_act": f.total})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeShelly) set(power, total float64, status int, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.power, f.total, f.status, f.body = power, total, status, body
+}
+
+func newShellyTest(t *testing.T, history time.Duration) (*ShellySource, *fakeShelly) {
+	t.Helper()
+	meter := &fakeShelly{}
+	server := httptest.NewServer(meter)
+	t.Cleanup(server.Close)
+
+	s, err := NewShellySource(ShellyConfig{
+		Devices:  []string{"Airport=" + strings.TrimPrefix(server.URL, "http://") + "/"},
+		Interval: time.Second,
+		History:  history,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, meter
+}
+
+func TestShellyPoll(t *testing.T) {
+	s, meter := newShellyTest(t, 0)
+	meter.set(1250, 4_321_500, 0, "")
+
+	start := time.Now()
+	s.poll(context.Background(), time.Now())
+	end := time.Now()
+
+	ctx := context.Background()
+	power, _ := s.CurrentPower(ctx, "Airport", start.Add(-time.Nanosecond), end)
+	if got := power["Airport"]; got != 1250 {
+		t.Errorf("power = %v W, want 1250", got)
+	}
+	meterReadings, _ := s.MeterReadings(ctx, "Airport", start.Add(-time.Nanosecond), end)
+	if got := meterReadings["Airport"]; got != 4321.5 {
+		t.Errorf("meter reading = %v kWh, want 4321.5", got)
+	}
+	want := []string{"/rpc/EM.GetStatus?id=0", "/rpc/EMData.GetStatus?id=0"}
+	if strings.Join(meter.requests, " ") != strings.Join(want, " ") {
+		t.Errorf("requests = %q, want %q", meter.requests, want)
+	}
+}
+
+func TestShellyHistory(t *testing.T) {
+	s, meter := newShellyTest(t, time.Hour)
+	start := time.Now()
+	meter.set(100, 1000, 0, "")
+	s.poll(context.Background(), start)
+	meter.set(200, 2000, 0, "")
+	s.poll(context.Background(), start.Add(10*time.Minute))
+	if n := len(s.sites["Airport"].power); n != 2 {
+		t.Fatalf("%d power readings within the history, want 2", n)
+	}
+
+	meter.set(300, 3000, 0, "")
+	s.poll(context.Background(), start.Add(80*time.Minute))
+	site := s.sites["Airport"]
+	if len(site.power) != 1 || site.power[0].Value != 300 {
+		t.Errorf("power readings = %v, want only the last", site.power)
+	}
+	if len(site.meter) != 1 || site.meter[0].Value != 3 {
+		t.Errorf("meter readings = %v, want only the last", site.meter)
+	}
+}
+
+func TestShellyErrors(t *testing.T) {
+	s, meter := newShellyTest(t, 0)
+	device := s.devices[0]
+
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		errorType string
+		message   string
+	}{
+		{
+			name:      "rpc error",
+			status:    http.StatusInternalServerError,
+			body:      `{"code":-105,"message":"Argument 'id', value 0 not found!"}`,
+			errorType: "rpc",
+			message:   "EM.GetStatus: Argument 'id', value 0 not found! (-105)",
+		},
+		{
+			name:      "bare status",
+			status:    http.StatusServiceUnavailable,
+			body:      "busy",
+			errorType: "http",
+			message:   "EM.GetStatus: 503 Service Unavailable",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meter.set(0, 0, tt.status, tt.body)
+			err := s.read(context.Background(), device, time.Now())
+			var queryErr *QueryError
+			if !errors.As(err, &queryErr) {
+				t.Fatalf("read = %v, want a QueryError", err)
+			}
+			if queryErr.System != "shelly" || queryErr.ErrorType != tt.errorType || queryErr.StatusCode != tt.status || queryErr.Message != tt.message {
+				t.Errorf("read = %+v, want shelly %s %q (%d)", *queryErr, tt.errorType, tt.message, tt.status)
+			}
+		})
+	}
+}
+
+func TestShellyRecovers(t *testing.T) {
+	s, meter := newShellyTest(t, 0)
+	device := s.devices[0]
+
+	meter.set(0, 0, http.StatusInternalServerError, `{"code":-114,"message":"Resource unavailable"}`)
+	s.poll(context.Background(), time.Now())
+	if !device.failing {
+		t.Fatal("device not failing after an RPC error")
+	}
+	if sites, _, _ := s.MemorySource.DiscoverSites(context.Background()); len(sites) != 0 {
+		t.Fatalf("readings %v kept from a failed poll", sites)
+	}
+
+	meter.set(800, 5000, 0, "")
+	start := time.Now()
+	s.poll(context.Background(), time.Now())
+	if device.failing {
+		t.Error("device still failing after a good poll")
+	}
+	power, _ := s.CurrentPower(context.Background(), "Airport", start.Add(-time.Nanosecond), time.Now())
+	if got := power["Airport"]; got != 800 {
+		t.Errorf("power after recovering = %v W, want 800", got)
+	}
+}
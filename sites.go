@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// SiteInfo is what gridwatch is told about a site, as opposed to what it
+// learns from the data.
+type SiteInfo struct {
+	Name     string       `json:"name"`
+	Groups   []string     `json:"groups,omitempty"`
+	Location *Coordinates `json:"location,omitempty"`
+}
+
+type Coordinates struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
+}
+
+// SiteRegistry is the configured list of sites, read from a JSON file of
+// the form
+//
+//	{"sites": [{"name": "Airport", "groups": ["st-marys"], "location": {"lat": 49.91, "lon": -6.29}}]}
+type SiteRegistry struct {
+	Sites []SiteInfo `json:"sites"`
+}
+
+// LoadSiteRegistry reads the registry at path. An empty path gives an empty
+// registry.
+func LoadSiteRegistry(path string) (*SiteRegistry, error) {
+	registry := &SiteRegistry{}
+	if path == "" {
+		return registry, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, registry); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// Group returns the names of the sites in group, or nil if no site is in it.
+func (r *SiteRegistry) Group(group string) (names []string) {
+	for _, site := range r.Sites {
+		for _, g := range site.Groups {
+			if g == group {
+				names = append(names, site.Name)
+				break
+			}
+		}
+	}
+	return names
+}
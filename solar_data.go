@@ -1,193 +1,127 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"net/url"
-	"strconv"
+	"maps"
+	"slices"
 	"strings"
 	"time"
+
+	"ios-gridwatch/api"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const generation_metric_name = "total_import"
-const generation_metric = generation_metric_name + "{purpose=\"solar\"}"
-const actual_power_metric_name = "total_act_power"
-const actual_power_metric = actual_power_metric_name + "{purpose=\"solar\"}"
-
-type SolarData struct {
-	Total_kwh float32    `json:"total_kwh"`
-	Day_kwh   float32    `json:"day_kwh"`
-	Week_kwh  float32    `json:"week_kwh"`
-	Year_kwh  float32    `json:"year_kwh"`
-	Current_w float32    `json:"current_w"`
-	Sites     []SiteData `json:"sites"`
-}
+// currentWindow is how old a power reading can be and still count as
+// current, matching Prometheus' lookback for instant queries.
+const currentWindow = 5 * time.Minute
 
-type SiteData struct {
-	Name     string  `json:"name"`
-	Snapshot float64 `json:"snapshot"`
-	Today    float64 `json:"today"`
-	Week     float64 `json:"week"`
-	Last_365 float64 `json:"year"`
-	Max      float64 `json:"max"`
-}
+// year is how far back meter readings and peaks are looked for.
+const year = 365 * 24 * time.Hour
 
-func get_solar_data(username string, password string, prometheusURL string, estDNC int, monitoredDNC int) (SolarData, error) {
-	var sites []SiteData
-	now := time.Now()
-	//year, month, day := now.Date()
-	//location := now.Location()
-	//midnight := time.Date(year, month, day, 0, 0, 0, 0, location)
-	//week := midnight.Add(-7 * 24 * time.Hour)
-	//one_year_ago := time.Date(year-1, month, day, 0, 0, 0, 0, location)
-	//timeFormat := "2006-01-02T15:04:05Z"
-	seconds_since_midnight_int := now.Hour()*3600 + now.Minute()*60 + now.Second()
-	//seconds_since_last_week_int := 7 * 24 * 60 * 60
-	seconds_since_midnight := strconv.FormatInt(int64(seconds_since_midnight_int), 10) + "s"
-	//seconds_since_last_week := strconv.FormatInt(int64(seconds_since_last_week_int), 10) + "s"
+// SolarData and SiteData live in package api so that Go clients can
+// decode them.
+type (
+	SolarData = api.SolarData
+	SiteData  = api.SiteData
+)
+
+// get_solar_data works out the live state as of now. Sites in known are
+// listed even if they have no readings.
+func get_solar_data(ctx context.Context, source DataSource, now time.Time, known []string, estDNC int, monitoredDNC int) (solarData SolarData, err error) {
+	ctx, span := tracer.Start(ctx, "get_solar_data")
+	defer func() { endSpan(span, err) }()
+
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
 
 	//get last 365 days statistics
-	increase_year, err := fetchPrometheusIncrease(username, password, prometheusURL, generation_metric, "365d")
+	increase_year, err := source.Energy(ctx, "", now.Add(-year), now)
 	if err != nil {
-		log.Printf("Error fetching old meter readings: %v\n", err)
+		LoggerFrom(ctx).Error("fetching yearly generation failed", "err", err)
 		return SolarData{}, err
 	}
-	var year_total float64
-
-	for _, site := range increase_year {
-		if len(sites) == 0 {
-			sites = append(sites, SiteData{Name: site.Metric.Site, Last_365: site.GetValue()})
-			year_total += site.GetValue()
-		} else {
-			for i := range sites {
-				if sites[i].Name == site.Metric.Site {
-					sites[i].Last_365 = site.GetValue()
-					year_total += site.GetValue()
-					break
-				} else if i == len(sites)-1 {
-					sites = append(sites, SiteData{Name: site.Metric.Site, Last_365: site.GetValue()})
-					year_total += site.GetValue()
-				}
-			}
-		}
-	}
 
 	//get weekly stistics
-	increase_week, err := fetchPrometheusIncrease(username, password, prometheusURL, generation_metric, "7d")
+	increase_week, err := source.Energy(ctx, "", now.Add(-7*24*time.Hour), now)
 	if err != nil {
-		log.Printf("Error fetching old meter readings: %v\n", err)
+		LoggerFrom(ctx).Error("fetching weekly generation failed", "err", err)
 		return SolarData{}, err
 	}
-	var week_total float64
-
-	for _, site := range increase_week {
-		for i := range sites {
-			if sites[i].Name == site.Metric.Site {
-				sites[i].Week = site.GetValue()
-				week_total += site.GetValue()
-				break
-			} else if i == len(sites)-1 {
-				sites = append(sites, SiteData{Name: site.Metric.Site, Week: site.GetValue()})
-				week_total += site.GetValue()
-			}
-		}
-	}
 
 	//get statistics for today
-	increase_day, err := fetchPrometheusIncrease(username, password, prometheusURL, generation_metric, seconds_since_midnight)
+	increase_day, err := source.Energy(ctx, "", midnight, now)
 	if err != nil {
-		log.Printf("Error fetching old meter readings: %v\n", err)
+		LoggerFrom(ctx).Error("fetching today's generation failed", "err", err)
 		return SolarData{}, err
 	}
-	var day_total float64
-
-	for _, site := range increase_day {
-		for i := range sites {
-			if sites[i].Name == site.Metric.Site {
-				sites[i].Today = site.GetValue()
-				day_total += site.GetValue()
-				break
-			} else if i == len(sites)-1 {
-				sites = append(sites, SiteData{Name: site.Metric.Site, Today: site.GetValue()})
-				day_total += site.GetValue()
-			}
-		}
-	}
 
 	//get max statistics
-	query := fmt.Sprintf("max_over_time(%s[1y])", actual_power_metric)
-	max_data, err := fetchPrometheusSnapshotData(username, password, prometheusURL, query, "")
+	max_data, err := source.PeakPower(ctx, "", now.Add(-year), now)
 	if err != nil {
-		log.Printf("Error fetching current output: %v\n", err)
+		LoggerFrom(ctx).Error("fetching peak output failed", "err", err)
 		return SolarData{}, err
 	}
 
-	for _, site := range max_data {
-		for i := range sites {
-			if sites[i].Name == site.Metric.Site {
-				sites[i].Max = site.GetValue()
-				break
-			} else if i == len(sites)-1 {
-				max_watts, _ := strconv.ParseFloat(site.Value[1].(string), 64)
-				sites = append(sites, SiteData{Name: site.Metric.Site, Max: max_watts})
-			}
-		}
-	}
-
 	//get snapshot statistics
-	latest_data, err := fetchPrometheusSnapshotData(username, password, prometheusURL, actual_power_metric, "")
+	latest_data, err := source.CurrentPower(ctx, "", now.Add(-currentWindow), now)
 	if err != nil {
-		log.Printf("Error fetching current output: %v\n", err)
+		LoggerFrom(ctx).Error("fetching current output failed", "err", err)
 		return SolarData{}, err
 	}
-	latest_total_watts := 0.0
-
-	for _, site := range latest_data {
-		for i := range sites {
-			if sites[i].Name == site.Metric.Site {
-				sites[i].Snapshot = site.GetValue()
-				latest_total_watts += sites[i].Snapshot
-				break
-			} else if i == len(sites)-1 {
-				site_watts, _ := strconv.ParseFloat(site.Value[1].(string), 64)
-				sites = append(sites, SiteData{Name: site.Metric.Site, Snapshot: site_watts})
-				latest_total_watts += site_watts
-			}
-		}
-	}
 
 	//all time data
-	query = fmt.Sprintf("sum(last_over_time(%s[1y]))", generation_metric)
-	all_time_data, err := fetchPrometheusVectorQuery(username, password, prometheusURL, query)
+	all_time_data, err := source.MeterReadings(ctx, "", now.Add(-year), now)
 	if err != nil {
-		log.Printf("Error fetching current output: %v\n", err)
+		LoggerFrom(ctx).Error("fetching all-time generation failed", "err", err)
 		return SolarData{}, err
 	}
 
+	names := map[string]bool{}
+	for _, name := range known {
+		names[name] = true
+	}
+	for _, readings := range []Readings{increase_year, increase_week, increase_day, max_data, latest_data} {
+		for name := range readings {
+			names[name] = true
+		}
+	}
+	var sites []SiteData
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		sites = append(sites, SiteData{
+			Name:     name,
+			Snapshot: latest_data[name],
+			Today:    increase_day[name],
+			Week:     increase_week[name],
+			Last_365: increase_year[name],
+			Max:      max_data[name],
+		})
+	}
+	year_total := increase_year.Total()
+	week_total := increase_week.Total()
+	day_total := increase_day.Total()
+	latest_total_watts := latest_data.Total()
+
 	//create a virtual site to represent unmonitored sites
 	//calculate the average of each value for the sites
 	var virtualSite SiteData
 
 	conversionFactor := float64(estDNC) / float64(monitoredDNC)
-	if len(sites) >= 0 {
-		for _, site := range sites {
-			virtualSite.Snapshot += site.Snapshot
-			virtualSite.Week += site.Week
-			virtualSite.Today += site.Today
-			virtualSite.Last_365 += site.Last_365
-			virtualSite.Max += site.Max
-		}
-		virtualSite.Snapshot *= conversionFactor
-		virtualSite.Today *= conversionFactor
-		virtualSite.Week *= conversionFactor
-		virtualSite.Last_365 *= conversionFactor
-		virtualSite.Max *= conversionFactor
-	}
-	virtualSite.Name = "Unmonitored (estimated)"
+	for _, site := range sites {
+		virtualSite.Snapshot += site.Snapshot
+		virtualSite.Week += site.Week
+		virtualSite.Today += site.Today
+		virtualSite.Last_365 += site.Last_365
+		virtualSite.Max += site.Max
+	}
+	virtualSite.Snapshot *= conversionFactor
+	virtualSite.Today *= conversionFactor
+	virtualSite.Week *= conversionFactor
+	virtualSite.Last_365 *= conversionFactor
+	virtualSite.Max *= conversionFactor
+	virtualSite.Name = unmonitoredSite
 
 	sites = append(sites, virtualSite)
 	week_total += virtualSite.Week
@@ -195,7 +129,8 @@ func get_solar_data(username string, password string, prometheusURL string, estD
 	latest_total_watts += virtualSite.Snapshot
 
 	return SolarData{
-		Total_kwh: float32(all_time_data.GetValue()),
+		Time:      now.UnixMilli(),
+		Total_kwh: float32(all_time_data.Total()),
 		Week_kwh:  float32(week_total),
 		Day_kwh:   float32(day_total),
 		Year_kwh:  float32(year_total),
@@ -203,462 +138,178 @@ func get_solar_data(username string, password string, prometheusURL string, estD
 		Sites:     sites}, nil
 }
 
-type PrometheusSnapshotResponse struct {
-	Data struct {
-		Result []PrometheusSnapshotData `json:"result"`
-	} `json:"data"`
-}
-
-type PrometheusVectorResponse struct {
-	Data struct {
-		Result []PrometheusVectorData `json:"result"`
-	} `json:"data"`
-}
-
-type PrometheusSnapshotData struct {
-	Metric struct {
-		Site string `json:"site"`
-	} `json:"metric"`
-	Value []interface{} `json:"value"`
-}
-
-type PrometheusVectorData struct {
-	Value []interface{} `json:"value"`
-}
-
-func (p PrometheusSnapshotData) GetValue() float64 {
-	value, _ := strconv.ParseFloat(p.Value[1].(string), 64)
-	return value
-}
-func (p PrometheusVectorData) GetValue() float64 {
-	value, _ := strconv.ParseFloat(p.Value[1].(string), 64)
-	return value
-}
-
-type PrometheusRangeResponse struct {
-	Data struct {
-		Result []PrometheusRangeData `json:"result"`
-	} `json:"data"`
-}
-
-type PrometheusRangeData struct {
-	Metric struct {
-		Name string `json:"__name__"`
-		Site string `json:"site"`
-	} `json:"metric"`
-	Values [][]interface{} `json:"values"`
-}
-
-func (p PrometheusRangeData) GetValues() (return_values []float64) {
-	for _, value := range p.Values {
-		v, _ := strconv.ParseFloat(value[1].(string), 64)
-		return_values = append(return_values, v)
-	}
-	return return_values
-}
-
-func fetchPrometheusSnapshotData(username string, password string, prometheusURL string, metric string, age string) ([]PrometheusSnapshotData, error) {
-	params := url.Values{}
-	params.Add("query", metric)
-	if age != "" {
-		params.Add("offset", age)
-	}
-	queryURL := prometheusURL + "?" + params.Encode()
-	req, err := http.NewRequest("GET", queryURL, nil)
-	if err != nil {
-		return []PrometheusSnapshotData{}, err
-	}
-	req.SetBasicAuth(username, password)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return []PrometheusSnapshotData{}, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return []PrometheusSnapshotData{}, err
-	}
-	var promResp PrometheusSnapshotResponse
-	err = json.Unmarshal(body, &promResp)
-	if err != nil {
-		return []PrometheusSnapshotData{}, err
-	}
-	return promResp.Data.Result, nil
-}
-
-func fetchPrometheusQuery(username string, password string, prometheusURL string, query string) ([]PrometheusSnapshotData, error) {
-	params := url.Values{}
-	params.Add("query", query)
-	queryURL := prometheusURL + "?" + params.Encode()
-	req, err := http.NewRequest("GET", queryURL, nil)
-	if err != nil {
-		return []PrometheusSnapshotData{}, err
-	}
-	req.SetBasicAuth(username, password)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return []PrometheusSnapshotData{}, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return []PrometheusSnapshotData{}, err
-	}
-	var promResp PrometheusSnapshotResponse
-	err = json.Unmarshal(body, &promResp)
-	if err != nil {
-		log.Printf("%+v", string(body))
-		return []PrometheusSnapshotData{}, err
-	}
-	return promResp.Data.Result, nil
-}
-
-func fetchPrometheusVectorQuery(username string, password string, prometheusURL string, query string) (PrometheusVectorData, error) {
-	params := url.Values{}
-	params.Add("query", query)
-	queryURL := prometheusURL + "?" + params.Encode()
-	req, err := http.NewRequest("GET", queryURL, nil)
-	if err != nil {
-		return PrometheusVectorData{}, err
-	}
-	req.Header.Set("Accept", "application/json")
-	req.SetBasicAuth(username, password)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return PrometheusVectorData{}, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return PrometheusVectorData{}, err
-	}
-	var promResp PrometheusVectorResponse
-	err = json.Unmarshal(body, &promResp)
-	if err != nil {
-		return PrometheusVectorData{}, err
-	}
-	if len(promResp.Data.Result) == 0 {
-		return PrometheusVectorData{}, errors.New("error with prometheus query")
-	}
-	return promResp.Data.Result[0], nil
-}
-
-func fetchPrometheusIncrease(username string, password string, prometheusURL string, metric string, period string) ([]PrometheusSnapshotData, error) {
-	query := fmt.Sprintf("delta(%s[%s])", metric, period)
-	params := url.Values{}
-	params.Add("query", query)
-	queryURL := prometheusURL + "?" + params.Encode()
-	req, err := http.NewRequest("GET", queryURL, nil)
-	if err != nil {
-		return []PrometheusSnapshotData{}, err
-	}
-	req.SetBasicAuth(username, password)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return []PrometheusSnapshotData{}, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return []PrometheusSnapshotData{}, err
-	}
-	var promResp PrometheusSnapshotResponse
-	err = json.Unmarshal(body, &promResp)
-	if err != nil {
-		return []PrometheusSnapshotData{}, err
-	}
-	return promResp.Data.Result, nil
-}
-
-func fetchPrometheusDataRange(username string, password string, prometheusURL string, query, start, end, step string) ([]PrometheusRangeData, error) {
-	// Build API request
-	params := url.Values{}
-	params.Add("query", query)
-	params.Add("start", start+"Z")
-	params.Add("end", end+"Z")
-	params.Add("step", step)
-	queryURL := prometheusURL + "_range?" + params.Encode()
-	req, err := http.NewRequest("GET", queryURL, nil)
-	if err != nil {
-		return []PrometheusRangeData{}, err
-	}
-	req.SetBasicAuth(username, password)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return []PrometheusRangeData{}, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return []PrometheusRangeData{}, err
-	}
-
-	// Parse JSON response
-	var promResp PrometheusRangeResponse
-	err = json.Unmarshal(body, &promResp)
-	if err != nil {
-		return []PrometheusRangeData{}, err
-	}
-
-	return promResp.Data.Result, nil
-}
-
-func fetchPrometheusRangeQuery(username string, password string, prometheusURL string, query string) ([]PrometheusRangeData, error) {
-	params := url.Values{}
-	params.Add("query", query)
-	queryURL := prometheusURL + "?" + params.Encode()
-	req, err := http.NewRequest("GET", queryURL, nil)
-	if err != nil {
-		return []PrometheusRangeData{}, err
-	}
-	req.SetBasicAuth(username, password)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return []PrometheusRangeData{}, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return []PrometheusRangeData{}, err
-	}
-	var promResp PrometheusRangeResponse
-	err = json.Unmarshal(body, &promResp)
-	if err != nil {
-		return []PrometheusRangeData{}, err
-	}
-	return promResp.Data.Result, nil
-}
-
 type SitePeriodData struct {
+	Time    int64           `json:"time"` // when the period ends, unix milliseconds
 	Name    string          `json:"name"`
 	Meter   float64         `json:"meter"`
 	Current float64         `json:"current"`
 	Period  float64         `json:"generation_in_period"`
 	Max     float64         `json:"max"`
 	Data    [][]interface{} `json:"data"`
-}
 
-type PeriodDataResponse struct {
-	Status string `json:"status"`
-	Data   struct {
-		ResultType string       `json:"resultType"`
-		Result     []PeriodData `json:"result"`
-	} `json:"data"`
+	// set when answering from the last good result while the data source
+	// is down, Age in milliseconds
+	Stale bool  `json:"stale,omitempty"`
+	Age   int64 `json:"age,omitempty"`
 }
 
 type PeriodData struct {
+	Time   int64           `json:"time,omitempty"` // as for SitePeriodData
 	Metric struct{}        `json:"metric"`
 	Values [][]interface{} `json:"values"`
+
+	// as for SitePeriodData
+	Stale bool  `json:"stale,omitempty"`
+	Age   int64 `json:"age,omitempty"`
 }
 
-func FetchTodaysGenerationData(username string, password string, prometheusURL string) (periodData PeriodData, err error) {
-	now := time.Now()
-	query := fmt.Sprintf("sum(avg_over_time(%s[30m]))", actual_power_metric)
-	params := url.Values{}
-	params.Add("query", query)
-	params.Add("start", string(now.Format("2006-01-02T00:00:00"))+"Z")
-	params.Add("end", string(now.Format("2006-01-02T15:04:05"))+"Z")
-	params.Add("step", "1800")
-	queryURL := prometheusURL + "_range?" + params.Encode()
-	req, err := http.NewRequest("GET", queryURL, nil)
+// errEmptyDataset means there is nothing to chart yet today.
+var errEmptyDataset = errors.New("empty dataset")
+
+// FetchTodaysGenerationData is the total power of every site, averaged over
+// each half hour from midnight to now.
+func FetchTodaysGenerationData(ctx context.Context, source DataSource, now time.Time) (periodData PeriodData, err error) {
+	ctx, span := tracer.Start(ctx, "FetchTodaysGenerationData")
+	defer func() { endSpan(span, err) }()
+
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	series, err := source.PowerSeries(ctx, "", midnight, now, 30*time.Minute)
 	if err != nil {
 		return PeriodData{}, err
 	}
-	req.SetBasicAuth(username, password)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return PeriodData{}, err
+	total := series.Sum()
+	if len(total) == 0 {
+		return PeriodData{}, errEmptyDataset
 	}
-	defer resp.Body.Close()
+	return PeriodData{Time: now.UnixMilli(), Values: seriesValues(total)}, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return PeriodData{}, err
-	}
+// maxPeriodDays is the longest period a client may ask about, ten years.
+const maxPeriodDays = 3660
 
-	// Parse JSON response
-	var promResp PeriodDataResponse
-	err = json.Unmarshal(body, &promResp)
-	if err != nil {
-		return PeriodData{}, err
-	}
-	if len(promResp.Data.Result) > 0 {
-		return promResp.Data.Result[0], nil
-	} else {
-		return PeriodData{}, fmt.Errorf("empty dataset for query:%s", query)
+// periodResolution is the step of the power series charted for a period.
+func periodResolution(numberOfDays int) time.Duration {
+	switch {
+	case numberOfDays <= 1:
+		return time.Minute
+	case numberOfDays <= 7:
+		return 15 * time.Minute
+	case numberOfDays <= 31:
+		return 3 * time.Hour
 	}
+	return 24 * time.Hour
 }
 
-func FetchSitePeriodData(username string, password string, prometheusURL string, site string, numberOfDays int) (sitePeriodData SitePeriodData, err error) {
-	var query1, query2, query3, query4, query5 string
+// seriesStart is the first point of a series with the given step covering
+// the period up to now, aligned to whole steps.
+func seriesStart(now time.Time, period time.Duration, step time.Duration) time.Time {
+	return now.Add(-period).Truncate(step).Add(step)
+}
+
+func FetchSitePeriodData(ctx context.Context, source DataSource, site string, numberOfDays int, now time.Time) (sitePeriodData SitePeriodData, err error) {
+	ctx, span := tracer.Start(ctx, "FetchSitePeriodData", trace.WithAttributes(
+		attribute.String("gridwatch.site", site),
+		attribute.Int("gridwatch.days", numberOfDays),
+	))
+	defer func() { endSpan(span, err) }()
+
+	sitePeriodData.Time = now.UnixMilli()
 	sitePeriodData.Name = strings.ReplaceAll(site, "+", " ")
-	if sitePeriodData.Name != "" {
-		query1 = fmt.Sprintf("%s{purpose=\"solar\", site=\"%s\"}", generation_metric_name, sitePeriodData.Name)
-		query2 = fmt.Sprintf("%s{purpose=\"solar\", site=\"%s\"}", actual_power_metric_name, sitePeriodData.Name)
-		if numberOfDays < 1 {
-			numberOfDays = 1
-		}
-		var resolution string
-		switch {
-		case numberOfDays <= 1:
-			resolution = "1m"
-		case numberOfDays <= 7:
-			resolution = "15m"
-		case numberOfDays <= 31:
-			resolution = "3h"
-		default:
-			resolution = "24h"
-		}
-		query3 = fmt.Sprintf("avg_over_time(%s{purpose=\"solar\", site=\"%s\"}[%s])[%vd:%s]", actual_power_metric_name, sitePeriodData.Name, resolution, numberOfDays, resolution)
-		query4 = fmt.Sprintf("delta(%s{purpose=\"solar\", site=\"%s\"}[%vd])", generation_metric_name, sitePeriodData.Name, numberOfDays)
-		query5 = fmt.Sprintf("max_over_time(%s{purpose=\"solar\", site=\"%s\"}[%vd])", actual_power_metric_name, sitePeriodData.Name, numberOfDays)
-	} else {
+	if sitePeriodData.Name == "" {
 		return SitePeriodData{}, errors.New("you must include a site name")
 	}
-	meter, err := fetchPrometheusQuery(username, password, prometheusURL, query1)
+	if numberOfDays < 1 {
+		numberOfDays = 1
+	}
+	period := time.Duration(numberOfDays) * 24 * time.Hour
+	resolution := periodResolution(numberOfDays)
+
+	meter, err := source.MeterReadings(ctx, sitePeriodData.Name, now.Add(-year), now)
 	if err != nil {
-		log.Printf("Query 1 error - %s", query1)
 		return sitePeriodData, err
 	}
-	if len(meter) < 1 {
+	reading, ok := meter[sitePeriodData.Name]
+	if !ok {
 		return sitePeriodData, errors.New("site: " + site + " - not found")
 	}
-	sitePeriodData.Meter = meter[0].GetValue()
+	sitePeriodData.Meter = reading
 
-	current_generation, err := fetchPrometheusQuery(username, password, prometheusURL, query2)
+	current_generation, err := source.CurrentPower(ctx, sitePeriodData.Name, now.Add(-currentWindow), now)
 	if err != nil {
-		log.Printf("Query 2 error - %s", query2)
 		return sitePeriodData, err
 	}
-	sitePeriodData.Current = current_generation[0].GetValue()
+	sitePeriodData.Current = current_generation[sitePeriodData.Name]
 
-	data, err := fetchPrometheusRangeQuery(username, password, prometheusURL, query3)
+	data, err := source.PowerSeries(ctx, sitePeriodData.Name, seriesStart(now, period, resolution), now, resolution)
 	if err != nil {
-		log.Printf("Query 3 error - %s", query3)
 		return sitePeriodData, err
 	}
-	sitePeriodData.Data = data[0].Values
+	sitePeriodData.Data = seriesValues(data[sitePeriodData.Name])
 
-	period_generation, err := fetchPrometheusQuery(username, password, prometheusURL, query4)
+	period_generation, err := source.Energy(ctx, sitePeriodData.Name, now.Add(-period), now)
 	if err != nil {
-		log.Printf("Query 4 error - %s", query4)
 		return sitePeriodData, err
 	}
-	sitePeriodData.Period = period_generation[0].GetValue()
+	sitePeriodData.Period = period_generation[sitePeriodData.Name]
 
-	maximum, err := fetchPrometheusQuery(username, password, prometheusURL, query5)
+	maximum, err := source.PeakPower(ctx, sitePeriodData.Name, now.Add(-period), now)
 	if err != nil {
-		log.Printf("Query 5 error - %s", query5)
 		return sitePeriodData, err
 	}
-	sitePeriodData.Max = maximum[0].GetValue()
+	sitePeriodData.Max = maximum[sitePeriodData.Name]
 
 	return
 }
 
-func FetchPeriodData(username string, password string, prometheusURL string, numberOfDays int) (sitePeriodData []SitePeriodData, err error) {
-	var query1, query2, query3, query4, query5 string
-	query1 = fmt.Sprintf("last_over_time(%s[1y])", generation_metric)
-	query2 = fmt.Sprintf("last_over_time(%s[1y])", actual_power_metric)
+func FetchPeriodData(ctx context.Context, source DataSource, numberOfDays int, now time.Time) (sitePeriodData []SitePeriodData, err error) {
+	ctx, span := tracer.Start(ctx, "FetchPeriodData", trace.WithAttributes(attribute.Int("gridwatch.days", numberOfDays)))
+	defer func() { endSpan(span, err) }()
+
 	if numberOfDays < 1 {
 		numberOfDays = 1
 	}
-	var resolution string
-	switch {
-	case numberOfDays <= 1:
-		resolution = "1m"
-	case numberOfDays <= 7:
-		resolution = "15m"
-	case numberOfDays <= 31:
-		resolution = "3h"
-	default:
-		resolution = "24h"
-	}
-	query3 = fmt.Sprintf("avg_over_time(%s[%s])[%vd:%s]", actual_power_metric, resolution, numberOfDays, resolution)
-	query4 = fmt.Sprintf("delta(%s[%vd])", generation_metric, numberOfDays)
-	query5 = fmt.Sprintf("max_over_time(%s[%vd])", actual_power_metric, numberOfDays)
+	period := time.Duration(numberOfDays) * 24 * time.Hour
+	resolution := periodResolution(numberOfDays)
 
-	meter, err := fetchPrometheusQuery(username, password, prometheusURL, query1)
+	meter, err := source.MeterReadings(ctx, "", now.Add(-year), now)
 	if err != nil {
 		return sitePeriodData, err
 	}
 	if len(meter) < 1 {
 		return sitePeriodData, errors.New("no results found")
 	}
-	for _, v := range meter {
-		siteData := SitePeriodData{Name: v.Metric.Site, Meter: v.GetValue()}
-		sitePeriodData = append(sitePeriodData, siteData)
-	}
 
-	current_generation, err := fetchPrometheusQuery(username, password, prometheusURL, query2)
+	current_generation, err := source.CurrentPower(ctx, "", now.Add(-currentWindow), now)
 	if err != nil {
 		return sitePeriodData, err
 	}
 
-	for _, v := range current_generation {
-		for i := range sitePeriodData {
-			if sitePeriodData[i].Name == v.Metric.Site {
-				sitePeriodData[i].Current = v.GetValue()
-				break
-			}
-		}
-	}
-
-	data, err := fetchPrometheusRangeQuery(username, password, prometheusURL, query3)
+	data, err := source.PowerSeries(ctx, "", seriesStart(now, period, resolution), now, resolution)
 	if err != nil {
 		return sitePeriodData, err
 	}
 
-	for _, v := range data {
-		for i := range sitePeriodData {
-			if sitePeriodData[i].Name == v.Metric.Site {
-				sitePeriodData[i].Data = v.Values
-				break
-			}
-		}
-	}
-
-	period_generation, err := fetchPrometheusQuery(username, password, prometheusURL, query4)
+	period_generation, err := source.Energy(ctx, "", now.Add(-period), now)
 	if err != nil {
 		return sitePeriodData, err
 	}
 
-	for _, v := range period_generation {
-		for i := range sitePeriodData {
-			if sitePeriodData[i].Name == v.Metric.Site {
-				sitePeriodData[i].Period = v.GetValue()
-				break
-			}
-		}
-	}
-
-	maximum, err := fetchPrometheusQuery(username, password, prometheusURL, query5)
+	maximum, err := source.PeakPower(ctx, "", now.Add(-period), now)
 	if err != nil {
 		return sitePeriodData, err
 	}
 
-	for _, v := range maximum {
-		for i := range sitePeriodData {
-			if sitePeriodData[i].Name == v.Metric.Site {
-				sitePeriodData[i].Max = v.GetValue()
-				break
-			}
-		}
+	for _, name := range meter.Sites() {
+		sitePeriodData = append(sitePeriodData, SitePeriodData{
+			Time:    now.UnixMilli(),
+			Name:    name,
+			Meter:   meter[name],
+			Current: current_generation[name],
+			Period:  period_generation[name],
+			Max:     maximum[name],
+			Data:    seriesValues(data[name]),
+		})
 	}
-
 	return
 }
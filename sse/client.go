@@ -0,0 +1,189 @@
+package sse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultRetry is how long Client waits before reconnecting until the
+// server sends a retry field.
+const DefaultRetry = 3 * time.Second
+
+// maxBackoff caps the delay between failed connection attempts.
+const maxBackoff = time.Minute
+
+// Client follows an event stream, reconnecting when it drops and resuming
+// from the last event ID it saw, as EventSource does.
+type Client struct {
+	URL        string
+	HTTPClient *http.Client // http.DefaultClient if nil
+	Header     http.Header  // extra request headers
+
+	// LastEventID is sent as Last-Event-ID when connecting, and kept up to
+	// date as events arrive.
+	LastEventID string
+	// Retry is the delay before reconnecting, updated by the server's
+	// retry fields. DefaultRetry if zero.
+	Retry time.Duration
+}
+
+// StatusError is a response that means the stream can't be read, as
+// opposed to one worth retrying.
+type StatusError struct {
+	StatusCode  int
+	ContentType string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("sse: unexpected response %d (%s)", e.StatusCode, e.ContentType)
+}
+
+// retryAfter is a response asking the client to come back later.
+type retryAfter struct {
+	statusCode int
+	delay      time.Duration
+}
+
+func (e *retryAfter) Error() string {
+	return fmt.Sprintf("sse: server busy (%d)", e.statusCode)
+}
+
+// Run connects and calls handle for each event with data, in order, until
+// ctx is done, handle returns an error, the server answers 204 No Content
+// or a response that can't be retried, or it sends an event too large to
+// read (ErrTooLarge). Dropped connections, 429s and 5xx
+// responses are retried, backing off while connecting keeps failing.
+func (c *Client) Run(ctx context.Context, handle func(*Event) error) error {
+	if _, err := http.NewRequest(http.MethodGet, c.URL, nil); err != nil {
+		return err
+	}
+	failures := 0
+	for {
+		connected, err := c.stream(ctx, handle)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var status *StatusError
+		var handlerErr *handlerError
+		switch {
+		case err == errNoContent:
+			return nil
+		case errors.As(err, &status), errors.Is(err, ErrTooLarge):
+			return err
+		case errors.As(err, &handlerErr):
+			return handlerErr.err
+		}
+
+		if connected {
+			failures = 0
+		} else {
+			failures++
+		}
+		delay := c.retry()
+		for i := 1; i < failures && delay < maxBackoff; i++ {
+			delay *= 2
+		}
+		delay = min(delay, maxBackoff)
+		var busy *retryAfter
+		if errors.As(err, &busy) && busy.delay > delay {
+			delay = busy.delay
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+var errNoContent = errors.New("sse: server asked the client to stop")
+
+type handlerError struct{ err error }
+
+func (e *handlerError) Error() string { return e.err.Error() }
+
+func (c *Client) retry() time.Duration {
+	if c.Retry > 0 {
+		return c.Retry
+	}
+	return DefaultRetry
+}
+
+// stream reads one connection until it ends. connected says whether the
+// server accepted the stream.
+func (c *Client) stream(ctx context.Context, handle func(*Event) error) (connected bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	for name, values := range c.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if c.LastEventID != "" {
+		req.Header.Set("Last-Event-ID", c.LastEventID)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	contentType := resp.Header.Get("Content-Type")
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return false, errNoContent
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return false, &retryAfter{statusCode: resp.StatusCode, delay: time.Duration(seconds) * time.Second}
+	case resp.StatusCode != http.StatusOK:
+		return false, &StatusError{StatusCode: resp.StatusCode, ContentType: contentType}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "text/event-stream" {
+		return false, &StatusError{StatusCode: resp.StatusCode, ContentType: contentType}
+	}
+
+	reader := NewReader(resp.Body)
+	for {
+		ev, err := reader.Next()
+		if err != nil {
+			return true, err
+		}
+		if ev.ID != nil {
+			c.LastEventID = string(ev.ID)
+		}
+		if ev.Retry != nil {
+			if ms, err := strconv.Atoi(string(ev.Retry)); err == nil {
+				c.Retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+		if ev.Data == nil {
+			continue
+		}
+		if err := handle(ev); err != nil {
+			return true, &handlerError{err}
+		}
+	}
+}
+
+// Decode unmarshals the JSON data of ev, for example into an api.SolarData
+// from gridwatch's unnamed messages or snapshot events.
+func Decode[T any](ev *Event) (v T, err error) {
+	err = json.Unmarshal(ev.Data, &v)
+	return v, err
+}
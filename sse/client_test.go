@@ -0,0 +1,223 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connection is one request the test server answered.
+type connection struct {
+	at          time.Time
+	lastEventID string
+	accept      string
+}
+
+// testServer answers the nth connection with answers[n], and 204 No
+// Content once they run out.
+func testServer(t *testing.T, answers ...http.HandlerFunc) (*httptest.Server, func() []connection) {
+	t.Helper()
+	var mu sync.Mutex
+	var connections []connection
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		n := len(connections)
+		connections = append(connections, connection{at: time.Now(), lastEventID: r.Header.Get("Last-Event-ID"), accept: r.Header.Get("Accept")})
+		mu.Unlock()
+		if n >= len(answers) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		answers[n](w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []connection {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]connection(nil), connections...)
+	}
+}
+
+// stream answers with body as an event stream, then drops the connection.
+func stream(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		fmt.Fprint(w, body)
+	}
+}
+
+func status(code int, retryAfter string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(code)
+	}
+}
+
+func TestClientResumes(t *testing.T) {
+	server, connections := testServer(t,
+		stream("retry: 20\n\nid: 1\ndata: a\n\n: keep alive\n\nid: 2\nevent: snapshot\ndata: b\n\n"),
+		stream("data: c\n\nid: 3\ndata: d\n\n"),
+	)
+	c := &Client{URL: server.URL, Retry: time.Hour}
+	var got []string
+	err := c.Run(context.Background(), func(ev *Event) error {
+		got = append(got, string(ev.Event)+":"+string(ev.Data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Run = %v, want nil after 204", err)
+	}
+	if want := ":a snapshot:b :c :d"; strings.Join(got, " ") != want {
+		t.Errorf("events = %q, want %q", strings.Join(got, " "), want)
+	}
+
+	conns := connections()
+	if len(conns) != 3 {
+		t.Fatalf("%d connections, want 3", len(conns))
+	}
+	for i, want := range []string{"", "2", "3"} {
+		if conns[i].lastEventID != want {
+			t.Errorf("connection %d sent Last-Event-ID %q, want %q", i, conns[i].lastEventID, want)
+		}
+		if conns[i].accept != "text/event-stream" {
+			t.Errorf("connection %d sent Accept %q", i, conns[i].accept)
+		}
+	}
+	// the server's retry replaces the hour the client started with
+	if c.Retry != 20*time.Millisecond {
+		t.Errorf("Retry = %v, want the server's 20ms", c.Retry)
+	}
+	if gap := conns[1].at.Sub(conns[0].at); gap < 20*time.Millisecond || gap > 10*time.Second {
+		t.Errorf("reconnected after %v, want the server's 20ms", gap)
+	}
+	if c.LastEventID != "3" {
+		t.Errorf("LastEventID = %q, want 3", c.LastEventID)
+	}
+}
+
+func TestClientStartsFromLastEventID(t *testing.T) {
+	server, connections := testServer(t)
+	c := &Client{URL: server.URL, LastEventID: "41"}
+	if err := c.Run(context.Background(), func(*Event) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if got := connections()[0].lastEventID; got != "41" {
+		t.Errorf("Last-Event-ID = %q, want 41", got)
+	}
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	server, connections := testServer(t,
+		status(http.StatusServiceUnavailable, "1"),
+		status(http.StatusTooManyRequests, ""),
+		status(http.StatusBadGateway, "soon"),
+	)
+	c := &Client{URL: server.URL, Retry: 10 * time.Millisecond}
+	if err := c.Run(context.Background(), func(*Event) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	conns := connections()
+	if len(conns) != 4 {
+		t.Fatalf("%d connections, want 4", len(conns))
+	}
+	if gap := conns[1].at.Sub(conns[0].at); gap < time.Second {
+		t.Errorf("came back after %v, want the 1s Retry-After asked for", gap)
+	}
+	// without a usable Retry-After the client backs off from its own delay
+	if gap := conns[2].at.Sub(conns[1].at); gap < 20*time.Millisecond || gap > time.Second {
+		t.Errorf("second retry after %v, want 20ms", gap)
+	}
+	if gap := conns[3].at.Sub(conns[2].at); gap < 40*time.Millisecond || gap > time.Second {
+		t.Errorf("third retry after %v, want 40ms", gap)
+	}
+}
+
+func TestClientStops(t *testing.T) {
+	handlerErr := errors.New("enough")
+	tests := []struct {
+		name   string
+		answer http.HandlerFunc
+		handle func(*Event) error
+		err    func(error) bool
+	}{
+		{
+			name:   "no content",
+			answer: status(http.StatusNoContent, ""),
+			err:    func(err error) bool { return err == nil },
+		},
+		{
+			name:   "not found",
+			answer: status(http.StatusNotFound, ""),
+			err: func(err error) bool {
+				var status *StatusError
+				return errors.As(err, &status) && status.StatusCode == http.StatusNotFound
+			},
+		},
+		{
+			name: "not an event stream",
+			answer: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, "{}")
+			},
+			err: func(err error) bool {
+				var status *StatusError
+				return errors.As(err, &status) && status.ContentType == "application/json"
+			},
+		},
+		{
+			name:   "handler error",
+			answer: stream("data: a\n\n"),
+			handle: func(*Event) error { return handlerErr },
+			err:    func(err error) bool { return err == handlerErr },
+		},
+		{
+			name:   "event too large",
+			answer: stream("data: " + strings.Repeat("x", DefaultMaxLine) + "\n\n"),
+			err:    func(err error) bool { return errors.Is(err, ErrTooLarge) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, connections := testServer(t, tt.answer, stream("data: never\n\n"))
+			handle := tt.handle
+			if handle == nil {
+				handle = func(*Event) error { return nil }
+			}
+			c := &Client{URL: server.URL, Retry: time.Millisecond}
+			if err := c.Run(context.Background(), handle); !tt.err(err) {
+				t.Errorf("Run = %v", err)
+			}
+			if n := len(connections()); n != 1 {
+				t.Errorf("%d connections, want 1", n)
+			}
+		})
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	server, _ := testServer(t, stream("data: a\n\n"))
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{URL: server.URL, Retry: time.Hour}
+	done := make(chan error)
+	go func() {
+		done <- c.Run(ctx, func(*Event) error { return nil })
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return when its context was cancelled")
+	}
+}
@@ -0,0 +1,263 @@
+package sse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte("42"), []byte("snapshot"), []byte(`{"current_w":1200}`), []byte("3000"), []byte(""))
+	f.Add([]byte(""), []byte(""), []byte("one\ntwo\r\nthree\rfour"), []byte(""), []byte("keep\nalive"))
+	f.Add([]byte("7"), []byte(" spaced"), []byte(" leading space"), []byte("x"), []byte(" c"))
+	f.Add([]byte(""), []byte(""), []byte(""), []byte(""), []byte("heartbeat"))
+	f.Add([]byte("a:b"), []byte("e:v"), []byte("\n"), []byte("10"), []byte(""))
+
+	f.Fuzz(func(t *testing.T, id, event, data, retry, comment []byte) {
+		ev := &Event{ID: id, Event: event, Data: data, Retry: retry, Comment: comment}
+		var buf bytes.Buffer
+		err := ev.MarshalTo(&buf)
+		if bytes.ContainsAny(id, "\r\n\x00") || bytes.ContainsAny(event, "\r\n\x00") || bytes.ContainsAny(retry, "\r\n\x00") {
+			if !errors.Is(err, ErrBadField) {
+				t.Fatalf("MarshalTo = %v, want ErrBadField", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("MarshalTo: %v", err)
+		}
+		if len(data) == 0 && len(comment) == 0 && len(retry) == 0 {
+			if buf.Len() != 0 {
+				t.Fatalf("empty event wrote %q", buf.String())
+			}
+			return
+		}
+
+		// id and event are only written with data, retry is only read
+		// back if it is a number, and any line break reads back as LF
+		var want Event
+		if len(data) > 0 {
+			want.ID, want.Event = id, event
+			want.Data = lineBreak.ReplaceAll(data, []byte("\n"))
+		}
+		if isDigits(retry) {
+			want.Retry = retry
+		}
+		if len(comment) > 0 {
+			want.Comment = lineBreak.ReplaceAll(comment, []byte("\n"))
+		}
+
+		r := NewReader(bytes.NewReader(buf.Bytes()))
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next on %q: %v", buf.String(), err)
+		}
+		for _, field := range []struct {
+			name      string
+			got, want []byte
+		}{
+			{"ID", got.ID, want.ID},
+			{"Event", got.Event, want.Event},
+			{"Data", got.Data, want.Data},
+			{"Retry", got.Retry, want.Retry},
+			{"Comment", got.Comment, want.Comment},
+		} {
+			if !bytes.Equal(field.got, field.want) {
+				t.Errorf("%s = %q, want %q (stream %q)", field.name, field.got, field.want, buf.String())
+			}
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Errorf("second Next = %v, want io.EOF", err)
+		}
+	})
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []Event
+		lastID string
+	}{
+		{
+			name:   "LF",
+			stream: "id: 1\ndata: a\n\nid: 2\ndata: b\n\n",
+			want:   []Event{{ID: []byte("1"), Data: []byte("a")}, {ID: []byte("2"), Data: []byte("b")}},
+			lastID: "2",
+		},
+		{
+			name:   "CR",
+			stream: "id: 1\rdata: a\r\rdata: b\r\r",
+			want:   []Event{{ID: []byte("1"), Data: []byte("a")}, {Data: []byte("b")}},
+			lastID: "1",
+		},
+		{
+			name:   "CRLF",
+			stream: "event: snapshot\r\ndata: a\r\n\r\ndata: b\r\n\r\n",
+			want:   []Event{{Event: []byte("snapshot"), Data: []byte("a")}, {Data: []byte("b")}},
+		},
+		{
+			name:   "mixed line endings",
+			stream: "data: a\rdata: b\ndata: c\r\n\n",
+			want:   []Event{{Data: []byte("a\nb\nc")}},
+		},
+		{
+			name:   "leading BOM",
+			stream: "\xef\xbb\xbfdata: a\n\n",
+			want:   []Event{{Data: []byte("a")}},
+		},
+		{
+			name:   "BOM only at the start",
+			stream: "data: a\n\n\xef\xbb\xbfdata: b\n\n",
+			want:   []Event{{Data: []byte("a")}, {}},
+		},
+		{
+			name:   "multi-line data",
+			stream: "data: one\ndata:two\ndata:  three\ndata\n\n",
+			want:   []Event{{Data: []byte("one\ntwo\n three\n")}},
+		},
+		{
+			name:   "comments",
+			stream: ": hello\n:world\ndata: a\n\n: heartbeat\n\n",
+			want:   []Event{{Data: []byte("a"), Comment: []byte("hello\nworld")}, {Comment: []byte("heartbeat")}},
+		},
+		{
+			name:   "bad retry",
+			stream: "retry: 10s\ndata: a\n\nretry: 3000\n\nretry:\n\n",
+			want:   []Event{{Data: []byte("a")}, {Retry: []byte("3000")}, {}},
+		},
+		{
+			name:   "id with NUL",
+			stream: "id: 5\ndata: a\n\nid: 6\x007\ndata: b\n\n",
+			want:   []Event{{ID: []byte("5"), Data: []byte("a")}, {Data: []byte("b")}},
+			lastID: "5",
+		},
+		{
+			name:   "unfinished event",
+			stream: "data: a\n\ndata: b\n",
+			want:   []Event{{Data: []byte("a")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.stream))
+			for i, want := range tt.want {
+				got, err := r.Next()
+				if err != nil {
+					t.Fatalf("event %d: %v", i, err)
+				}
+				if !bytes.Equal(got.ID, want.ID) || !bytes.Equal(got.Event, want.Event) || !bytes.Equal(got.Data, want.Data) ||
+					!bytes.Equal(got.Retry, want.Retry) || !bytes.Equal(got.Comment, want.Comment) {
+					t.Errorf("event %d = %+q, want %+q", i, *got, want)
+				}
+			}
+			if _, err := r.Next(); err != io.EOF {
+				t.Errorf("Next after the events = %v, want io.EOF", err)
+			}
+			if got := r.LastEventID(); got != tt.lastID {
+				t.Errorf("LastEventID = %q, want %q", got, tt.lastID)
+			}
+		})
+	}
+}
+
+func TestMarshalTo(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   Event
+		want string
+		err  error
+	}{
+		{
+			name: "full event",
+			ev:   Event{ID: []byte("1"), Event: []byte("snapshot"), Data: []byte("a"), Retry: []byte("3000")},
+			want: "id: 1\ndata: a\nevent: snapshot\nretry: 3000\n\n",
+		},
+		{
+			name: "line breaks in data",
+			ev:   Event{Data: []byte("a\rb\r\nc\nd")},
+			want: "data: a\ndata: b\ndata: c\ndata: d\n\n",
+		},
+		{
+			name: "comment only",
+			ev:   Event{Comment: []byte("keep\nalive")},
+			want: ": keep\n: alive\n\n",
+		},
+		{
+			name: "retry only",
+			ev:   Event{Retry: []byte("5000")},
+			want: "retry: 5000\n\n",
+		},
+		{
+			name: "nothing to send",
+			ev:   Event{ID: []byte("1"), Event: []byte("snapshot")},
+		},
+		{
+			name: "line break in id",
+			ev:   Event{ID: []byte("1\n2"), Data: []byte("a")},
+			err:  ErrBadField,
+		},
+		{
+			name: "NUL in event",
+			ev:   Event{Event: []byte("a\x00"), Data: []byte("a")},
+			err:  ErrBadField,
+		},
+		{
+			name: "CR in retry",
+			ev:   Event{Retry: []byte("1\r")},
+			err:  ErrBadField,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := tt.ev.MarshalTo(&buf)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("MarshalTo = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && buf.String() != tt.want {
+				t.Errorf("MarshalTo wrote %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestReaderLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		stream   string
+		maxLine  int
+		maxEvent int
+		events   int // read before the error
+	}{
+		{"long line", "data: short\n\ndata: " + strings.Repeat("x", 100) + "\n\n", 64, 1024, 1},
+		{"long line without an end", strings.Repeat("x", 100), 64, 1024, 0},
+		{"long comment", ": " + strings.Repeat("x", 100) + "\n\n", 64, 1024, 0},
+		{"many data lines", "data: a\n\n" + strings.Repeat("data: "+strings.Repeat("x", 30)+"\n", 10) + "\n", 64, 200, 1},
+		{"many comments", strings.Repeat(": "+strings.Repeat("x", 30)+"\n", 10) + "data: a\n\n", 64, 200, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.stream))
+			r.MaxLine, r.MaxEvent = tt.maxLine, tt.maxEvent
+			for i := range tt.events {
+				if _, err := r.Next(); err != nil {
+					t.Fatalf("event %d: %v", i, err)
+				}
+			}
+			if _, err := r.Next(); !errors.Is(err, ErrTooLarge) {
+				t.Errorf("Next = %v, want ErrTooLarge", err)
+			}
+		})
+	}
+
+	// right up to the limits is fine
+	line := "data: " + strings.Repeat("x", 58)
+	r := NewReader(strings.NewReader(line + "\n" + line + "\n\n"))
+	r.MaxLine, r.MaxEvent = len(line), 2*(len(line)-len("data: ")+1)
+	if ev, err := r.Next(); err != nil || len(ev.Data) != 2*58+1 {
+		t.Errorf("Next at the limits = %v, %v", ev, err)
+	}
+}
@@ -0,0 +1,162 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Default limits on what a Reader holds in memory.
+const (
+	DefaultMaxLine  = 1 << 20
+	DefaultMaxEvent = 4 << 20
+)
+
+// ErrTooLarge is returned by Next for a line or event over the Reader's
+// limits. The rest of the stream can't be read.
+var ErrTooLarge = errors.New("sse: line or event too large")
+
+// Reader parses an event stream as the HTML standard describes: lines may
+// end in CR, LF or CRLF, a leading byte order mark is skipped, data lines
+// are joined with LF, and an event ends at a blank line.
+//
+// Unlike a browser, Reader also returns blocks without data, so that
+// callers can see retry hints and comments, and it keeps comments in
+// Event.Comment instead of dropping them.
+type Reader struct {
+	// MaxLine and MaxEvent bound, in bytes, one line and the data and
+	// comments of one event, so that a misbehaving server can't exhaust
+	// memory.
+	MaxLine  int
+	MaxEvent int
+
+	r       *bufio.Reader
+	started bool // past any byte order mark
+	skipLF  bool // the last line ended in CR, so a following LF is part of it
+	lastID  []byte
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{MaxLine: DefaultMaxLine, MaxEvent: DefaultMaxEvent, r: bufio.NewReader(r)}
+}
+
+// LastEventID is the event stream's last event ID: the value of the most
+// recent id field, carried over events that don't set one.
+func (r *Reader) LastEventID() string {
+	return string(r.lastID)
+}
+
+// Next returns the next event. ID is non-nil only when the event had an id
+// field, Data only when it had a data field. At the end of the stream Next
+// returns io.EOF, discarding any unfinished event as a browser would.
+func (r *Reader) Next() (*Event, error) {
+	ev := &Event{}
+	var data []byte
+	var comments [][]byte
+	size := 0 // of data and comments
+	empty := true
+
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 {
+			if empty {
+				continue
+			}
+			if data != nil {
+				ev.Data = bytes.TrimSuffix(data, []byte("\n"))
+			}
+			if comments != nil {
+				ev.Comment = bytes.Join(comments, []byte("\n"))
+			}
+			return ev, nil
+		}
+		empty = false
+
+		field, value := line, []byte{}
+		if colon := bytes.IndexByte(line, ':'); colon >= 0 {
+			field, value = line[:colon], line[colon+1:]
+			value = bytes.TrimPrefix(value, []byte(" "))
+		}
+
+		switch string(field) {
+		case "":
+			if size += len(value) + 1; size > r.MaxEvent {
+				return nil, ErrTooLarge
+			}
+			comments = append(comments, value)
+		case "event":
+			ev.Event = value
+		case "data":
+			if size += len(value) + 1; size > r.MaxEvent {
+				return nil, ErrTooLarge
+			}
+			data = append(data, value...)
+			data = append(data, '\n')
+		case "id":
+			// an ID containing NUL is ignored
+			if bytes.IndexByte(value, 0) < 0 {
+				ev.ID = value
+				r.lastID = value
+			}
+		case "retry":
+			if isDigits(value) {
+				ev.Retry = value
+			}
+		}
+	}
+}
+
+// readLine returns the next line without its line ending. The error is only
+// non-nil when the stream ends, including partway through a line.
+func (r *Reader) readLine() ([]byte, error) {
+	if !r.started {
+		r.started = true
+		if bom, err := r.r.Peek(3); err == nil && string(bom) == "\xef\xbb\xbf" {
+			r.r.Discard(3)
+		}
+	}
+
+	line := []byte{}
+	for {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if r.skipLF {
+			r.skipLF = false
+			if b == '\n' {
+				continue
+			}
+		}
+		switch b {
+		case '\n':
+			return line, nil
+		case '\r':
+			// don't wait to see whether LF follows, or a live stream
+			// ending its lines in CR would stall
+			r.skipLF = true
+			return line, nil
+		}
+		if len(line) >= r.MaxLine {
+			return nil, ErrTooLarge
+		}
+		line = append(line, b)
+	}
+}
+
+func isDigits(value []byte) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for _, b := range value {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return true
+}
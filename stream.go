@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ServeSSE streams hub updates to each client. shutdown is cancelled when
+// the server starts shutting down.
+func ServeSSE(hub *Hub, shutdown context.Context, cfg SSEConfig, sites *SiteRegistry) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		logger := LoggerFrom(c.Request().Context()).With("ip", c.RealIP())
+
+		// clients that ask for typed events get deltas, everyone else the
+		// full state as an unnamed message each update
+		stream := &sseStream{
+			w:            c.Response(),
+			rc:           http.NewResponseController(c.Response()),
+			writeTimeout: cfg.WriteTimeout,
+		}
+		if c.QueryParams().Has("events") {
+			types, err := ParseEventTypes(c.QueryParam("events"))
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+			}
+			stream.types = types
+		}
+		filter, err := FilterFromQuery(c.QueryParams(), sites)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+		}
+		stream.filter = filter
+
+		logger.Info("SSE client connected", "events", describeTypes(stream.types), "sites", filter.Sites, "fields", filter.Fields)
+		w := c.Response()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		// tell the browser how long to wait before reconnecting, which also
+		// gets the headers out before the first update is ready. Without a
+		// delay to give, the browser keeps its own rather than being told
+		// to reconnect at once.
+		hello := &Event{Comment: []byte("connected")}
+		if cfg.Retry > 0 {
+			hello = &Event{Retry: []byte(strconv.FormatInt(cfg.Retry.Milliseconds(), 10))}
+		}
+		if err := stream.write(hello); err != nil {
+			return nil
+		}
+
+		// a reconnecting EventSource says where it got up to
+		lastEventID := c.Request().Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = c.QueryParam("lastEventId")
+		}
+		updates, backlog, resumed := hub.Subscribe(lastEventID)
+		defer hub.Unsubscribe(updates)
+		if resumed {
+			logger.Info("SSE client resumed", "last_event_id", lastEventID, "replayed", len(backlog))
+			stream.started = true
+		}
+
+		for _, ev := range backlog {
+			if err := stream.send(ev); err != nil {
+				logger.Info("SSE client lost", "err", err)
+				return nil
+			}
+		}
+
+		// with no heartbeat, beats is nil and never fires
+		var heartbeat *time.Ticker
+		var beats <-chan time.Time
+		if cfg.Heartbeat > 0 {
+			heartbeat = time.NewTicker(cfg.Heartbeat)
+			defer heartbeat.Stop()
+			beats = heartbeat.C
+		}
+
+		for {
+			select {
+			case <-c.Request().Context().Done():
+				logger.Info("SSE client disconnected")
+				return nil
+			case <-shutdown.Done():
+				logger.Info("SSE client closed for shutdown")
+				stream.write(shutdownEvent())
+				return nil
+			case <-beats:
+				if err := stream.write(&Event{Comment: []byte("heartbeat")}); err != nil {
+					logger.Info("SSE client lost", "err", err)
+					return nil
+				}
+			case ev, ok := <-updates:
+				if !ok {
+					return nil
+				}
+				if err := stream.send(ev); err != nil {
+					logger.Info("SSE client lost", "err", err)
+					return nil
+				}
+				if heartbeat != nil {
+					heartbeat.Reset(cfg.Heartbeat)
+				}
+			}
+		}
+	}
+}
+
+// sseStream writes hub updates to one client in the form it asked for.
+type sseStream struct {
+	w            *echo.Response
+	rc           *http.ResponseController
+	writeTimeout time.Duration
+	types        EventTypes
+	filter       Filter
+
+	// started is set once the client has a starting state, after which
+	// typed streams only receive changes
+	started bool
+}
+
+func (s *sseStream) send(ev HubEvent) error {
+	ev, err := ev.View(s.filter)
+	if err != nil {
+		return err
+	}
+	var events []*Event
+	if problem := ev.ErrorEvent(); problem != nil {
+		events = append(events, problem)
+	}
+	switch {
+	case s.types == nil:
+		events = append(events, ev.Message())
+	case ev.Error != nil:
+		// stale data only goes out as a snapshot; a stream that doesn't
+		// take snapshots is brought up to date once fetching recovers
+		if s.types[EventSnapshot] && ev.Snapshot != nil {
+			events = append(events, ev.SnapshotEvent())
+			s.started = true
+		}
+		return s.write(events...)
+	case !s.started:
+		initial, err := ev.Initial(s.types)
+		if err != nil {
+			return err
+		}
+		events = append(events, initial...)
+	default:
+		events = append(events, ev.Changes(s.types)...)
+	}
+	s.started = true
+	return s.write(events...)
+}
+
+// write sends events and flushes them. A client that can't take them within
+// the write timeout is treated as gone, so a dead connection is noticed at
+// the next heartbeat rather than left holding a goroutine.
+func (s *sseStream) write(events ...*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	if s.writeTimeout > 0 {
+		if err := s.rc.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil {
+			return err
+		}
+	}
+	for _, event := range events {
+		if err := event.MarshalTo(s.w); err != nil {
+			return err
+		}
+	}
+	return s.rc.Flush()
+}
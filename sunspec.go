@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SunSpec lays a device's registers out as a chain of models after a
+// "SunS" marker, each starting with its ID and length. gridwatch reads the
+// inverter models 101, 102 and 103 (single, split and three phase), whose
+// values are integers with scale factors.
+const (
+	sunspecMarker0 = 0x5375 // "Su"
+	sunspecMarker1 = 0x6e53 // "nS"
+	sunspecEnd     = 0xffff
+
+	sunspecCommon       = 1
+	sunspecCommonLength = 66
+	sunspecInverterLen  = 50
+)
+
+// sunspecBases are where the marker may be.
+var sunspecBases = []uint16{40000, 0, 50000}
+
+// Offsets into the body of an inverter model.
+const (
+	sunspecW     = 12
+	sunspecWSF   = 13
+	sunspecWH    = 22 // acc32, two registers
+	sunspecWHSF  = 24
+	sunspecDCA   = 25
+	sunspecDCASF = 26
+	sunspecDCV   = 27
+	sunspecDCVSF = 28
+	sunspecSt    = 36
+)
+
+// sunspecStatus names the operating states of an inverter model's St.
+var sunspecStatus = map[uint16]string{
+	1: "off",
+	2: "sleeping",
+	3: "starting",
+	4: "mppt",
+	5: "throttled",
+	6: "shutting down",
+	7: "fault",
+	8: "standby",
+}
+
+// InverterReading is the latest an inverter said about itself.
+type InverterReading struct {
+	Site       string  `json:"site"`
+	Time       int64   `json:"time"`       // unix milliseconds, 0 if never read
+	Power      float64 `json:"power"`      // AC watts
+	Energy     float64 `json:"energy"`     // lifetime kWh
+	DCVoltage  float64 `json:"dc_voltage"` // volts
+	DCCurrent  float64 `json:"dc_current"` // amps
+	Status     string  `json:"status"`
+	StatusCode int     `json:"status_code"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// SunSpecSource polls inverters that serve SunSpec inverter models over
+// Modbus TCP, one inverter to a site. Like ShellySource it keeps only the
+// last cfg.History of readings.
+type SunSpecSource struct {
+	*MemorySource
+
+	inverters []*sunspecInverter
+	interval  time.Duration
+	history   time.Duration
+
+	mu     sync.RWMutex
+	latest map[string]InverterReading
+}
+
+type sunspecInverter struct {
+	site   string
+	client *ModbusClient
+	model  int // register of the inverter model's body, -1 until found
+
+	simulator *SunSpecSimulator // feeding this inverter, if simulated
+}
+
+// NewSunSpecSource reads cfg.Devices, each a site name and the inverter's
+// host[:port][/unit], as in Big Array=10.0.0.7:502/1. The port defaults
+// to 502 and the unit to 1. An address of "simulator" starts an
+// in-process simulated inverter for the site, following the sun at its
+// location in registry.
+func NewSunSpecSource(cfg InverterConfig, registry *SiteRegistry) (*SunSpecSource, error) {
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("the inverter poll interval must be positive")
+	}
+	s := &SunSpecSource{MemorySource: NewMemorySource(), interval: cfg.Interval, history: cfg.History, latest: map[string]InverterReading{}}
+	for _, device := range cfg.Devices {
+		site, addr, ok := strings.Cut(device, "=")
+		site, addr = strings.TrimSpace(site), strings.TrimSpace(addr)
+		if !ok || site == "" || addr == "" {
+			return nil, fmt.Errorf("bad inverter %q, want site=host[:port][/unit]", device)
+		}
+		inverter := &sunspecInverter{site: site, model: -1}
+		if addr == "simulator" {
+			sim, err := NewSunSpecSimulator("127.0.0.1:0")
+			if err != nil {
+				return nil, err
+			}
+			sim.Follow(site, registry)
+			inverter.simulator = sim
+			addr = sim.Addr()
+		}
+		unit := 1
+		if host, u, ok := strings.Cut(addr, "/"); ok {
+			n, err := strconv.Atoi(u)
+			if err != nil || n < 0 || n > 255 {
+				return nil, fmt.Errorf("bad inverter %q: bad unit %q", device, u)
+			}
+			addr, unit = host, n
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "502")
+		}
+		inverter.client = NewModbusClient(addr, byte(unit), 5*time.Second)
+		s.inverters = append(s.inverters, inverter)
+		s.latest[site] = InverterReading{Site: site}
+	}
+	return s, nil
+}
+
+// DiscoverSites lists every configured site, read yet or not.
+func (s *SunSpecSource) DiscoverSites(ctx context.Context) ([]string, []map[string]string, error) {
+	sites := make([]string, len(s.inverters))
+	for i, inverter := range s.inverters {
+		sites[i] = inverter.site
+	}
+	return sites, nil, nil
+}
+
+// Inverters returns the latest reading of each inverter, by site.
+func (s *SunSpecSource) Inverters() []InverterReading {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	readings := make([]InverterReading, 0, len(s.latest))
+	for _, reading := range s.latest {
+		readings = append(readings, reading)
+	}
+	slices.SortFunc(readings, func(a, b InverterReading) int { return strings.Compare(a.Site, b.Site) })
+	return readings
+}
+
+// Run polls every inverter each interval until ctx is done.
+func (s *SunSpecSource) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	defer func() {
+		for _, inverter := range s.inverters {
+			inverter.client.Close()
+			if inverter.simulator != nil {
+				inverter.simulator.Close()
+			}
+		}
+	}()
+
+	for {
+		s.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll reads every inverter at once, then forgets readings older than the
+// history.
+func (s *SunSpecSource) poll(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, min(s.interval, fetchTimeout))
+	defer cancel()
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	for _, inverter := range s.inverters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if inverter.simulator != nil {
+				inverter.simulator.Update(now)
+			}
+			reading, err := inverter.read(ctx)
+			s.record(inverter.site, now, reading, err)
+		}()
+	}
+	wg.Wait()
+	if s.history > 0 {
+		s.Forget(now.Add(-s.history))
+	}
+}
+
+// record keeps a reading, logging the inverter failing, recovering or
+// changing state.
+func (s *SunSpecSource) record(site string, at time.Time, reading InverterReading, err error) {
+	s.mu.Lock()
+	prev := s.latest[site]
+	if err != nil {
+		// what was last read stays, marked with why it isn't newer
+		reading = prev
+		reading.Error = err.Error()
+	} else {
+		reading.Site, reading.Time = site, at.UnixMilli()
+	}
+	s.latest[site] = reading
+	s.mu.Unlock()
+
+	switch {
+	case err != nil && prev.Error == "":
+		slog.Warn("reading inverter failed", "site", site, "err", err)
+		return
+	case err != nil:
+		return
+	case prev.Error != "":
+		slog.Info("reading inverter again", "site", site)
+	}
+	if reading.StatusCode != prev.StatusCode && prev.Time != 0 {
+		level := slog.LevelInfo
+		if reading.Status == "fault" {
+			level = slog.LevelWarn
+		}
+		slog.Log(context.Background(), level, "inverter changed state", "site", site, "status", reading.Status, "was", prev.Status)
+	}
+	s.Add(site, MeasurePower, Point{Time: at, Value: reading.Power})
+	s.Add(site, MeasureMeter, Point{Time: at, Value: reading.Energy})
+}
+
+// read takes one reading, finding the inverter model first if need be.
+func (i *sunspecInverter) read(ctx context.Context) (InverterReading, error) {
+	if i.model < 0 {
+		model, err := findSunSpecInverter(ctx, i.client)
+		if err != nil {
+			return InverterReading{}, err
+		}
+		i.model = model
+	}
+	regs, err := i.client.ReadHoldingRegisters(ctx, uint16(i.model), sunspecInverterLen)
+	if err != nil {
+		var modbusErr *ModbusError
+		if errors.As(err, &modbusErr) {
+			// the map may have moved, after a firmware update say
+			i.model = -1
+		}
+		return InverterReading{}, err
+	}
+	power, ok := sunspecValue(regs[sunspecW], regs[sunspecWSF], true)
+	if !ok {
+		return InverterReading{}, errors.New("inverter doesn't report its power")
+	}
+	reading := InverterReading{Power: power, StatusCode: int(regs[sunspecSt])}
+	wh := uint32(regs[sunspecWH])<<16 | uint32(regs[sunspecWH+1])
+	if wh == 0 {
+		return InverterReading{}, errors.New("inverter doesn't report its lifetime energy")
+	}
+	sf := int16(regs[sunspecWHSF])
+	if sf == math.MinInt16 {
+		sf = 0
+	}
+	reading.Energy = float64(wh) * math.Pow10(int(sf)) / 1000
+	reading.DCVoltage, _ = sunspecValue(regs[sunspecDCV], regs[sunspecDCVSF], false)
+	reading.DCCurrent, _ = sunspecValue(regs[sunspecDCA], regs[sunspecDCASF], false)
+	reading.Status = sunspecStatus[regs[sunspecSt]]
+	if reading.Status == "" {
+		reading.Status = "unknown"
+	}
+	return reading, nil
+}
+
+// sunspecValue scales a register by its scale factor. ok is false if the
+// inverter doesn't implement the value.
+func sunspecValue(register uint16, sf uint16, signed bool) (value float64, ok bool) {
+	if int16(sf) == math.MinInt16 {
+		return 0, false
+	}
+	if signed {
+		if int16(register) == math.MinInt16 {
+			return 0, false
+		}
+		return float64(int16(register)) * math.Pow10(int(int16(sf))), true
+	}
+	if register == 0xffff {
+		return 0, false
+	}
+	return float64(register) * math.Pow10(int(int16(sf))), true
+}
+
+// findSunSpecInverter walks the chain of models for an inverter model and
+// returns the register its body starts at.
+func findSunSpecInverter(ctx context.Context, client *ModbusClient) (int, error) {
+	var base int
+	for _, b := range sunspecBases {
+		regs, err := client.ReadHoldingRegisters(ctx, b, 2)
+		if err != nil {
+			var modbusErr *ModbusError
+			if errors.As(err, &modbusErr) {
+				continue
+			}
+			return 0, err
+		}
+		if regs[0] == sunspecMarker0 && regs[1] == sunspecMarker1 {
+			base = int(b) + 2
+			break
+		}
+	}
+	if base == 0 {
+		return 0, errors.New("no SunSpec marker found")
+	}
+	for addr, n := base, 0; addr+2 <= 0xffff && n < 64; n++ {
+		regs, err := client.ReadHoldingRegisters(ctx, uint16(addr), 2)
+		if err != nil {
+			return 0, err
+		}
+		id, length := regs[0], int(regs[1])
+		switch {
+		case id == sunspecEnd:
+			return 0, errors.New("no SunSpec inverter model found")
+		case id >= 101 && id <= 103 && length >= sunspecInverterLen:
+			return addr + 2, nil
+		case id >= 111 && id <= 113:
+			return 0, fmt.Errorf("SunSpec float inverter model %d isn't supported", id)
+		}
+		addr += 2 + length
+	}
+	return 0, errors.New("no SunSpec inverter model found")
+}
+
+// SunSpecSimulator is a three phase inverter serving SunSpec over Modbus
+// TCP, for trying gridwatch out without one.
+type SunSpecSimulator struct {
+	server   *ModbusServer
+	listener net.Listener
+	model    uint16 // register of the inverter model's body
+
+	demo *DemoSource // what it follows, if anything
+}
+
+// NewSunSpecSimulator starts a simulator listening on addr, reporting
+// nothing generated until it is told otherwise.
+func NewSunSpecSimulator(addr string) (*SunSpecSimulator, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sim := &SunSpecSimulator{server: NewModbusServer(), listener: l}
+
+	common := make([]uint16, 2+sunspecCommonLength)
+	common[0], common[1] = sunspecCommon, sunspecCommonLength
+	copy(common[2:], sunspecString("gridwatch", 16))
+	copy(common[18:], sunspecString("simulator", 16))
+	sim.server.SetRegisters(40000, []uint16{sunspecMarker0, sunspecMarker1})
+	sim.server.SetRegisters(40002, common)
+	inverter := 40002 + uint16(len(common))
+	sim.server.SetRegisters(inverter, []uint16{103, sunspecInverterLen})
+	sim.model = inverter + 2
+	sim.server.SetRegisters(sim.model+sunspecInverterLen, []uint16{sunspecEnd, 0})
+	sim.Set(InverterReading{Status: "sleeping", StatusCode: 2})
+
+	go sim.server.Serve(l)
+	return sim, nil
+}
+
+// Addr is where the simulator listens.
+func (s *SunSpecSimulator) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *SunSpecSimulator) Close() error {
+	return s.listener.Close()
+}
+
+// Follow has the simulator report the made-up readings DemoSource gives
+// site, at its location in registry, whenever Update is called.
+func (s *SunSpecSimulator) Follow(site string, registry *SiteRegistry) {
+	info := SiteInfo{Name: site}
+	for _, registered := range registry.Sites {
+		if registered.Name == site {
+			info = registered
+		}
+	}
+	s.demo = NewDemoSource(&SiteRegistry{Sites: []SiteInfo{info}})
+}
+
+// Update sets the readings to what the followed site gives at t.
+func (s *SunSpecSimulator) Update(t time.Time) {
+	if s.demo == nil {
+		return
+	}
+	power := s.demo.power(0, t.Truncate(demoStep))
+	reading := InverterReading{Power: power, Energy: s.demo.meter(0, t), Status: "sleeping", StatusCode: 2}
+	if power > 0 {
+		// strings of panels near their maximum power point
+		reading.DCVoltage = 600
+		reading.DCCurrent = power / 0.97 / reading.DCVoltage
+		reading.Status, reading.StatusCode = "mppt", 4
+	}
+	s.Set(reading)
+}
+
+// Set writes reading into the inverter model.
+func (s *SunSpecSimulator) Set(reading InverterReading) {
+	// everything not set here is unimplemented: 0xffff for unsigned
+	// values, 0x8000 for signed ones and scale factors
+	regs := make([]uint16, sunspecInverterLen)
+	for i := range regs {
+		regs[i] = 0xffff
+	}
+	for _, i := range []int{4, 11, 15, 16, 17, 18, 19, 20, 21, 29, 30, 31, 32, 33, 34, 35} {
+		regs[i] = 0x8000
+	}
+	regs[sunspecW], regs[sunspecWSF] = sunspecScaled(reading.Power, true)
+	wh := uint32(math.Round(reading.Energy * 1000))
+	regs[sunspecWH], regs[sunspecWH+1], regs[sunspecWHSF] = uint16(wh>>16), uint16(wh), 0
+	regs[sunspecDCV], regs[sunspecDCVSF] = sunspecScaled(reading.DCVoltage, false)
+	regs[sunspecDCA], regs[sunspecDCASF] = sunspecScaled(reading.DCCurrent, false)
+	regs[sunspecSt] = uint16(reading.StatusCode)
+	s.server.SetRegisters(s.model, regs)
+}
+
+// sunspecScaled writes value with the finest scale factor that fits it in
+// a register.
+func sunspecScaled(value float64, signed bool) (register uint16, sf uint16) {
+	limit := float64(math.MaxUint16 - 1)
+	if signed {
+		limit = math.MaxInt16
+	}
+	for exp := -2; exp < 6; exp++ {
+		scaled := math.Round(value / math.Pow10(exp))
+		if math.Abs(scaled) <= limit {
+			return uint16(int64(scaled)), uint16(int16(exp))
+		}
+	}
+	return 0x8000, 0x8000
+}
+
+// sunspecString packs s into n registers, two bytes to each, padded with
+// NULs.
+func sunspecString(s string, n int) []uint16 {
+	b := make([]byte, 2*n)
+	copy(b, s)
+	regs := make([]uint16, n)
+	for i := range regs {
+		regs[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return regs
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// startModbus serves server on a local port until the test ends.
+func startModbus(t *testing.T, server *ModbusServer) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go server.Serve(l)
+	return l.Addr().String()
+}
+
+// sunspecDevice lays out a SunSpec register map at base: the marker, then
+// the given models, each an ID and body, then the end marker. It returns
+// the register each model's body starts at.
+func sunspecDevice(server *ModbusServer, base uint16, models ...[]uint16) []uint16 {
+	server.SetRegisters(base, []uint16{sunspecMarker0, sunspecMarker1})
+	addr := base + 2
+	var bodies []uint16
+	for _, model := range models {
+		server.SetRegisters(addr, []uint16{model[0], uint16(len(model) - 1)})
+		server.SetRegisters(addr+2, model[1:])
+		bodies = append(bodies, addr+2)
+		addr += 2 + uint16(len(model)-1)
+	}
+	server.SetRegisters(addr, []uint16{sunspecEnd, 0})
+	return bodies
+}
+
+// inverterModel is an inverter model with every value unimplemented but
+// those in set.
+func inverterModel(id uint16, set map[int]uint16) []uint16 {
+	model := make([]uint16, 1+sunspecInverterLen)
+	model[0] = id
+	for i := range sunspecInverterLen {
+		model[1+i] = 0xffff
+	}
+	for _, i := range []int{sunspecW, sunspecWSF, sunspecWHSF, sunspecDCASF, sunspecDCVSF} {
+		model[1+i] = 0x8000
+	}
+	for i, v := range set {
+		model[1+i] = v
+	}
+	return model
+}
+
+func commonModel() []uint16 {
+	model := make([]uint16, 1+sunspecCommonLength)
+	model[0] = sunspecCommon
+	copy(model[1:], sunspecString("Fronius", 16))
+	return model
+}
+
+func TestSunSpecRead(t *testing.T) {
+	sf := func(exp int16) uint16 { return uint16(exp) }
+	registers := map[int]uint16{
+		sunspecW:      12345,
+		sunspecWSF:    sf(-1),
+		sunspecWH:     0x0001,
+		sunspecWH + 1: 0x86a0, // 100000
+		sunspecWHSF:   sf(1),
+		sunspecDCV:    6012,
+		sunspecDCVSF:  sf(-1),
+		sunspecDCA:    345,
+		sunspecDCASF:  sf(-2),
+		sunspecSt:     4,
+	}
+	nameplate := append([]uint16{120}, make([]uint16, 26)...)
+
+	tests := []struct {
+		name  string
+		base  uint16
+		model uint16
+	}{
+		{"single phase", 40000, 101},
+		{"split phase", 0, 102},
+		{"three phase", 50000, 103},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewModbusServer()
+			bodies := sunspecDevice(server, tt.base, commonModel(), nameplate, inverterModel(tt.model, registers))
+			client := NewModbusClient(startModbus(t, server), 1, time.Second)
+			defer client.Close()
+
+			model, err := findSunSpecInverter(context.Background(), client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if model != int(bodies[2]) {
+				t.Fatalf("inverter model found at %d, want %d", model, bodies[2])
+			}
+
+			inverter := &sunspecInverter{site: "Big Array", client: client, model: -1}
+			reading, err := inverter.read(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := InverterReading{Power: 1234.5, Energy: 1000, DCVoltage: 601.2, DCCurrent: 3.45, Status: "mppt", StatusCode: 4}
+			if !closeReading(reading, want) {
+				t.Errorf("read = %+v, want %+v", reading, want)
+			}
+		})
+	}
+}
+
+func TestSunSpecStatus(t *testing.T) {
+	server := NewModbusServer()
+	model := inverterModel(103, map[int]uint16{sunspecW: 0, sunspecWSF: 0, sunspecWH + 1: 1, sunspecWHSF: 0})
+	body := sunspecDevice(server, 40000, commonModel(), model)[1]
+	client := NewModbusClient(startModbus(t, server), 1, time.Second)
+	defer client.Close()
+	inverter := &sunspecInverter{client: client, model: -1}
+
+	for st, want := range map[uint16]string{
+		1: "off", 2: "sleeping", 3: "starting", 4: "mppt",
+		5: "throttled", 6: "shutting down", 7: "fault", 8: "standby",
+		0: "unknown", 99: "unknown",
+	} {
+		server.SetRegisters(body+sunspecSt, []uint16{st})
+		reading, err := inverter.read(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reading.Status != want || reading.StatusCode != int(st) {
+			t.Errorf("St %d read as %q (%d), want %q", st, reading.Status, reading.StatusCode, want)
+		}
+	}
+}
+
+func TestSunSpecNoInverter(t *testing.T) {
+	tests := []struct {
+		name   string
+		models [][]uint16
+		marker bool
+		err    string
+	}{
+		{"no marker", nil, false, "no SunSpec marker found"},
+		{"common model only", [][]uint16{commonModel()}, true, "no SunSpec inverter model found"},
+		{"meter only", [][]uint16{commonModel(), append([]uint16{203}, make([]uint16, 105)...)}, true, "no SunSpec inverter model found"},
+		{"float inverter", [][]uint16{commonModel(), append([]uint16{113}, make([]uint16, 60)...)}, true, "SunSpec float inverter model 113 isn't supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewModbusServer()
+			if tt.marker {
+				sunspecDevice(server, 40000, tt.models...)
+			}
+			client := NewModbusClient(startModbus(t, server), 1, time.Second)
+			defer client.Close()
+
+			inverter := &sunspecInverter{client: client, model: -1}
+			_, err := inverter.read(context.Background())
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("read = %v, want %q", err, tt.err)
+			}
+			if inverter.model != -1 {
+				t.Errorf("model set to %d without an inverter", inverter.model)
+			}
+		})
+	}
+}
+
+func TestModbusException(t *testing.T) {
+	client := NewModbusClient(startModbus(t, NewModbusServer()), 1, time.Second)
+	defer client.Close()
+
+	_, err := client.ReadHoldingRegisters(context.Background(), 65500, 100)
+	var modbusErr *ModbusError
+	if !errors.As(err, &modbusErr) || modbusErr.Code != 2 {
+		t.Fatalf("reading past the end = %v, want illegal data address", err)
+	}
+	// an exception leaves the connection usable
+	if _, err := client.ReadHoldingRegisters(context.Background(), 0, 10); err != nil {
+		t.Errorf("reading after an exception: %v", err)
+	}
+}
+
+func TestSunSpecSourcePoll(t *testing.T) {
+	sim, err := NewSunSpecSimulator("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+	sim.Set(InverterReading{Power: 4321.7, Energy: 98765.432, DCVoltage: 612.5, DCCurrent: 7.25, StatusCode: 5})
+
+	s, err := NewSunSpecSource(InverterConfig{Devices: []string{"Big Array=" + sim.Addr() + "/3"}, Interval: time.Second}, &SiteRegistry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.inverters[0].client.Close()
+
+	start := time.Now()
+	s.poll(context.Background())
+	readings := s.Inverters()
+	if len(readings) != 1 {
+		t.Fatalf("Inverters = %v, want one", readings)
+	}
+	want := InverterReading{Site: "Big Array", Power: 4322, Energy: 98765.432, DCVoltage: 612.5, DCCurrent: 7.25, Status: "throttled", StatusCode: 5}
+	if got := readings[0]; got.Time < start.UnixMilli() || !closeReading(got, want) {
+		t.Errorf("reading = %+v, want %+v", got, want)
+	}
+	power, _ := s.CurrentPower(context.Background(), "Big Array", start.Add(-time.Nanosecond), time.Now())
+	if power["Big Array"] != 4322 {
+		t.Errorf("power = %v, want 4322", power)
+	}
+
+	sim.Close()
+	s.inverters[0].client.Close()
+	s.poll(context.Background())
+	got := s.Inverters()[0]
+	if got.Error == "" || got.Power != want.Power {
+		t.Errorf("after the inverter went away = %+v, want the last reading with an error", got)
+	}
+}
+
+func closeReading(got, want InverterReading) bool {
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-6 }
+	return got.Site == want.Site && near(got.Power, want.Power) && near(got.Energy, want.Energy) &&
+		near(got.DCVoltage, want.DCVoltage) && near(got.DCCurrent, want.DCCurrent) &&
+		got.Status == want.Status && got.StatusCode == want.StatusCode && got.Error == want.Error
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// wsReadLimit caps the size of a message from a WebSocket client. Requests
+// are small; anything bigger is a misbehaving client.
+const wsReadLimit = 8 << 10
+
+// wsMessage is a message on the /ws feed, in either direction.
+//
+// Clients send:
+//
+//	{"type": "subscribe", "sites": [...], "groups": [...], "fields": [...]}
+//	{"type": "unsubscribe", "sites": [...], "groups": [...], "fields": [...]}
+//	{"type": "ping"}
+//
+// and receive "subscribed", "unsubscribed", "update" (with id and data
+// holding the SolarData), "pong" and "error" (with message, and with id and
+// data holding an UpstreamError when live data couldn't be fetched).
+type wsMessage struct {
+	Type    string          `json:"type"`
+	Sites   []string        `json:"sites,omitempty"`
+	Groups  []string        `json:"groups,omitempty"`
+	Fields  []string        `json:"fields,omitempty"`
+	ID      uint64          `json:"id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+// ServeWS carries the hub's live updates over WebSocket. Nothing is sent
+// until the client subscribes. Ping frames go out every heartbeat and a
+// client that answers neither them nor anything else is dropped. sockets
+// counts open connections, which the server's Shutdown does not track.
+func ServeWS(hub *Hub, shutdown context.Context, cfg SSEConfig, sites *SiteRegistry, allowOrigins []string, sockets *sync.WaitGroup) echo.HandlerFunc {
+	upgrader := websocket.Upgrader{CheckOrigin: originAllowed(allowOrigins)}
+
+	return func(c echo.Context) error {
+		logger := LoggerFrom(c.Request().Context()).With("ip", c.RealIP())
+
+		conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+		if err != nil {
+			// the upgrader has already written the error response
+			logger.Info("WebSocket upgrade failed", "err", err)
+			return nil
+		}
+		sockets.Add(1)
+		defer sockets.Done()
+		defer conn.Close()
+		logger.Info("WebSocket client connected")
+
+		stream := &wsStream{conn: conn, writeTimeout: cfg.WriteTimeout, sites: sites}
+		updates, backlog, _ := hub.Subscribe("")
+		defer hub.Unsubscribe(updates)
+		if len(backlog) > 0 {
+			stream.latest = &backlog[len(backlog)-1]
+		}
+
+		// the reader hands requests to this goroutine, which does all the
+		// writing
+		// with no heartbeat there are no pings to answer, so a quiet
+		// client is never dropped
+		awaitClient := func() error { return nil }
+		if cfg.Heartbeat > 0 {
+			pongWait := 2*cfg.Heartbeat + cfg.WriteTimeout
+			awaitClient = func() error { return conn.SetReadDeadline(time.Now().Add(pongWait)) }
+		}
+		conn.SetReadLimit(wsReadLimit)
+		awaitClient()
+		conn.SetPongHandler(func(string) error { return awaitClient() })
+		requests := make(chan wsMessage)
+		readErr := make(chan error, 1)
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					readErr <- err
+					return
+				}
+				awaitClient()
+				var msg wsMessage
+				if err := json.Unmarshal(data, &msg); err != nil {
+					msg = wsMessage{Type: "invalid", Message: err.Error()}
+				}
+				select {
+				case requests <- msg:
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		var pings <-chan time.Time
+		if cfg.Heartbeat > 0 {
+			ping := time.NewTicker(cfg.Heartbeat)
+			defer ping.Stop()
+			pings = ping.C
+		}
+
+		for {
+			select {
+			case err := <-readErr:
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					logger.Info("WebSocket client disconnected")
+				} else {
+					logger.Info("WebSocket client lost", "err", err)
+				}
+				return nil
+			case <-shutdown.Done():
+				logger.Info("WebSocket client closed for shutdown")
+				stream.close(websocket.CloseGoingAway, "server shutting down")
+				return nil
+			case <-pings:
+				if err := conn.WriteControl(websocket.PingMessage, nil, stream.deadline()); err != nil {
+					logger.Info("WebSocket client lost", "err", err)
+					return nil
+				}
+			case msg := <-requests:
+				if err := stream.handle(msg); err != nil {
+					logger.Info("WebSocket client lost", "err", err)
+					return nil
+				}
+			case ev, ok := <-updates:
+				if !ok {
+					stream.close(websocket.CloseTryAgainLater, "too slow")
+					return nil
+				}
+				// a full state supersedes any queued behind it, so a
+				// client that has fallen behind skips straight to the
+				// newest
+				for queued := len(updates); queued > 0; queued-- {
+					if ev, ok = <-updates; !ok {
+						stream.close(websocket.CloseTryAgainLater, "too slow")
+						return nil
+					}
+				}
+				if err := stream.update(ev); err != nil {
+					logger.Info("WebSocket client lost", "err", err)
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// originAllowed accepts same-origin browsers, clients that send no Origin
+// and any origin the CORS config allows.
+func originAllowed(allowOrigins []string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || slices.Contains(allowOrigins, "*") || slices.Contains(allowOrigins, origin) {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+}
+
+// wsStream is one WebSocket client and what it has subscribed to.
+type wsStream struct {
+	conn         *websocket.Conn
+	writeTimeout time.Duration
+	sites        *SiteRegistry
+
+	active bool
+	filter Filter // empty Sites or Fields mean every site or field
+
+	// latest is the newest update, sent to the client when it subscribes
+	latest *HubEvent
+}
+
+var errSubscribedToAll = errors.New("subscribed to all of them; subscribe to the ones wanted instead")
+
+// handle answers a request from the client. Only a failed write is
+// returned; bad requests get an error message.
+func (s *wsStream) handle(msg wsMessage) error {
+	var err error
+	switch msg.Type {
+	case "ping":
+		return s.write(wsMessage{Type: "pong"})
+	case "subscribe":
+		err = s.subscribe(msg)
+	case "unsubscribe":
+		err = s.unsubscribe(msg)
+	case "invalid":
+		err = errors.New(msg.Message)
+	default:
+		err = fmt.Errorf("unknown message type %q", msg.Type)
+	}
+	if err != nil {
+		return s.write(wsMessage{Type: "error", Message: err.Error()})
+	}
+
+	if !s.active {
+		return s.write(wsMessage{Type: "unsubscribed"})
+	}
+	if err := s.write(wsMessage{Type: "subscribed", Sites: s.filter.Sites, Fields: s.filter.Fields}); err != nil {
+		return err
+	}
+	if s.latest != nil {
+		return s.update(*s.latest)
+	}
+	return nil
+}
+
+// subscribe adds sites and fields to the subscription. A list left out of
+// the request keeps what is already subscribed to, or means all of them on
+// a new subscription; {"type": "subscribe"} asks for everything.
+func (s *wsStream) subscribe(msg wsMessage) error {
+	add, err := ParseFilter(msg.Sites, msg.Groups, msg.Fields, s.sites)
+	if err != nil {
+		return err
+	}
+	if add.IsZero() {
+		s.active = true
+		s.filter = Filter{}
+		return nil
+	}
+	merge := func(current []string, added []string) []string {
+		if !s.active {
+			return added
+		}
+		if len(added) == 0 || len(current) == 0 {
+			return current
+		}
+		merged := slices.Concat(current, added)
+		slices.Sort(merged)
+		return slices.Compact(merged)
+	}
+	s.filter = Filter{Sites: merge(s.filter.Sites, add.Sites), Fields: merge(s.filter.Fields, add.Fields)}
+	s.active = true
+	return nil
+}
+
+// unsubscribe takes sites and fields out of the subscription. Leaving out
+// both lists, or removing the last site or field, ends it.
+func (s *wsStream) unsubscribe(msg wsMessage) error {
+	remove, err := ParseFilter(msg.Sites, msg.Groups, msg.Fields, s.sites)
+	if err != nil {
+		return err
+	}
+	if !s.active || remove.IsZero() {
+		s.active = false
+		s.filter = Filter{}
+		return nil
+	}
+	without := func(current []string, removed []string) ([]string, error) {
+		if len(removed) == 0 {
+			return current, nil
+		}
+		if len(current) == 0 {
+			return nil, errSubscribedToAll
+		}
+		return slices.DeleteFunc(slices.Clone(current), func(item string) bool {
+			return slices.Contains(removed, item)
+		}), nil
+	}
+	sites, err := without(s.filter.Sites, remove.Sites)
+	if err != nil {
+		return err
+	}
+	fields, err := without(s.filter.Fields, remove.Fields)
+	if err != nil {
+		return err
+	}
+	if (len(remove.Sites) > 0 && len(sites) == 0) || (len(remove.Fields) > 0 && len(fields) == 0) {
+		s.active = false
+		s.filter = Filter{}
+		return nil
+	}
+	s.filter = Filter{Sites: sites, Fields: fields}
+	return nil
+}
+
+// update sends the full state of ev as the client's subscription sees it.
+func (s *wsStream) update(ev HubEvent) error {
+	s.latest = &ev
+	if !s.active {
+		return nil
+	}
+	view, err := ev.View(s.filter)
+	if err != nil {
+		return err
+	}
+	if view.Error != nil {
+		var problem UpstreamError
+		if err := json.Unmarshal(view.Error, &problem); err != nil {
+			return err
+		}
+		if err := s.write(wsMessage{Type: "error", ID: view.ID, Message: problem.Message, Data: view.Error}); err != nil {
+			return err
+		}
+		if view.Snapshot == nil {
+			return nil
+		}
+	}
+	return s.write(wsMessage{Type: "update", ID: view.ID, Data: view.Snapshot})
+}
+
+func (s *wsStream) write(msg wsMessage) error {
+	if err := s.conn.SetWriteDeadline(s.deadline()); err != nil {
+		return err
+	}
+	return s.conn.WriteJSON(msg)
+}
+
+func (s *wsStream) close(code int, reason string) {
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), s.deadline())
+}
+
+// deadline is when a write started now must be done by, or zero for no
+// limit.
+func (s *wsStream) deadline() time.Time {
+	if s.writeTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(s.writeTimeout)
+}